@@ -0,0 +1,149 @@
+package wbxml
+
+import (
+	"bytes"
+	"fmt"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/japanese"
+	"golang.org/x/text/encoding/korean"
+	"golang.org/x/text/encoding/simplifiedchinese"
+	"golang.org/x/text/encoding/traditionalchinese"
+	"golang.org/x/text/encoding/unicode"
+	"golang.org/x/text/transform"
+)
+
+// MIBenums of the charsets read as-is, UTF-8 being a superset of US-ASCII.
+const (
+	mibUnknown = 0
+	mibASCII   = 3
+	mibUTF8    = 106
+)
+
+// charsets maps the IANA MIBenum of a charset to its encoding.
+var charsets = map[uint32]encoding.Encoding{
+	4:    charmap.ISO8859_1,
+	5:    charmap.ISO8859_2,
+	6:    charmap.ISO8859_3,
+	7:    charmap.ISO8859_4,
+	8:    charmap.ISO8859_5,
+	9:    charmap.ISO8859_6,
+	10:   charmap.ISO8859_7,
+	11:   charmap.ISO8859_8,
+	12:   charmap.ISO8859_9,
+	13:   charmap.ISO8859_10,
+	17:   japanese.ShiftJIS,
+	18:   japanese.EUCJP,
+	38:   korean.EUCKR,
+	39:   japanese.ISO2022JP,
+	109:  charmap.ISO8859_13,
+	110:  charmap.ISO8859_14,
+	111:  charmap.ISO8859_15,
+	112:  charmap.ISO8859_16,
+	113:  simplifiedchinese.GBK,
+	114:  simplifiedchinese.GB18030,
+	1013: unicode.UTF16(unicode.BigEndian, unicode.IgnoreBOM),
+	1014: unicode.UTF16(unicode.LittleEndian, unicode.IgnoreBOM),
+	1015: unicode.UTF16(unicode.BigEndian, unicode.UseBOM),
+	2026: traditionalchinese.Big5,
+	2084: charmap.KOI8R,
+	2250: charmap.Windows1250,
+	2251: charmap.Windows1251,
+	2252: charmap.Windows1252,
+	2253: charmap.Windows1253,
+	2254: charmap.Windows1254,
+	2255: charmap.Windows1255,
+	2256: charmap.Windows1256,
+	2257: charmap.Windows1257,
+	2258: charmap.Windows1258,
+}
+
+// wideCharsets are the MIBenums of the charsets whose NUL, terminating the strings of the
+// document, is two bytes wide.
+var wideCharsets = map[uint32]bool{1013: true, 1014: true, 1015: true}
+
+// setCharset selects the decoder converting the strings of the document to UTF-8, from
+// the MIBenum of the header. Strings of an unknown charset are converted from
+// DefaultCharset if set, else they are read as-is, or rejected in strict mode.
+func (d *Decoder) setCharset(mib uint32) error {
+	d.text, d.tabText = nil, nil
+	d.wide = wideCharsets[mib]
+	if mib == mibASCII || mib == mibUTF8 {
+		return nil
+	}
+	enc, ok := charsets[mib]
+	switch {
+	case ok:
+	case d.DefaultCharset != nil:
+		enc = d.DefaultCharset
+		d.warn("unknown charset MIBenum %d, decoded with DefaultCharset", mib)
+	case d.Strict && mib != mibUnknown:
+		return fmt.Errorf("unknown charset MIBenum %d", mib)
+	default:
+		return nil
+	}
+	d.text, d.tabText = enc.NewDecoder(), enc.NewDecoder()
+	return nil
+}
+
+// stringEnd returns the index of the NUL terminating the string at the start of data, or
+// -1 if there is none. In UTF-16, the NUL is two zero bytes at a code unit boundary, so
+// that the zero high byte of a character such as 'a' (0x00 0x61) does not end the string.
+func (d *Decoder) stringEnd(data []byte) int {
+	if !d.wide {
+		return bytes.IndexByte(data, 0)
+	}
+	for i := 0; i+1 < len(data); i += 2 {
+		if data[i] == 0 && data[i+1] == 0 {
+			return i
+		}
+	}
+	return -1
+}
+
+// convert converts the inline string str to UTF-8 from the charset of the document. The
+// state of the conversion is kept from one inline string to the next, for stateful charsets
+// like ISO-2022-JP whose escape sequences select a character set up to the next escape
+// sequence, even in a following string. A string ending with an incomplete character gets
+// U+FFFD for it.
+func (d *Decoder) convert(str []byte) ([]byte, error) {
+	if d.text == nil {
+		return str, nil
+	}
+	return transformString(d.text, str)
+}
+
+// convertTable converts str, an entry of the string table, to UTF-8 from the charset of
+// the document. An entry may be referenced from anywhere in the document, so it is
+// converted from the initial state of the charset, and leaves the state of the inline
+// strings alone.
+func (d *Decoder) convertTable(str []byte) ([]byte, error) {
+	if d.tabText == nil {
+		return str, nil
+	}
+	d.tabText.Reset()
+	return transformString(d.tabText, str)
+}
+
+// transformString converts str with text, from its current state.
+func transformString(text *encoding.Decoder, str []byte) ([]byte, error) {
+	result := make([]byte, 0, len(str))
+	buf := make([]byte, 2*len(str)+utf8.UTFMax)
+	atEOF := false
+	for {
+		nDst, nSrc, err := text.Transform(buf, str, atEOF)
+		result = append(result, buf[:nDst]...)
+		str = str[nSrc:]
+		switch err {
+		case nil:
+			return result, nil
+		case transform.ErrShortDst:
+		case transform.ErrShortSrc:
+			atEOF = true
+		default:
+			return nil, err
+		}
+	}
+}
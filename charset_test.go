@@ -0,0 +1,120 @@
+package wbxml
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/text/encoding/charmap"
+)
+
+type textMsg struct {
+	Data string
+}
+
+func TestDecoderDefaultCharset(t *testing.T) {
+	// charset 2000 is not a registered MIBenum, 'é' is 0xE9 in Latin-1
+	input := []byte{0x03, 0x01, 0x8F, 0x50, 0x00, 0x6D, 0x4F, 0x03, 'd', 0xE9, 'j', 0xE0, 0x00, 0x01, 0x01}
+
+	d := NewDecoder(bytes.NewReader(input), syncMLTags, CodeSpace{})
+	d.DefaultCharset = charmap.ISO8859_1
+	var msg textMsg
+	err := d.Decode(&msg)
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	assert.Equal(t, uint32(2000), d.Header.Charset)
+	assert.Equal(t, textMsg{Data: "déjà"}, msg)
+
+	d = NewDecoder(bytes.NewReader(input), syncMLTags, CodeSpace{})
+	msg = textMsg{}
+	err = d.Decode(&msg)
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	assert.Equal(t, textMsg{Data: "d\xE9j\xE0"}, msg)
+
+	d = NewDecoder(bytes.NewReader(input), syncMLTags, CodeSpace{})
+	d.Strict = true
+	err = d.Decode(&msg)
+	if err == nil {
+		t.Errorf("expected an error for an unknown charset")
+	}
+}
+
+func TestDecoderCharset(t *testing.T) {
+	// charset 4 is ISO-8859-1
+	input := []byte{0x03, 0x01, 0x04, 0x00, 0x6D, 0x4F, 0x03, 'd', 0xE9, 'j', 0xE0, 0x00, 0x01, 0x01}
+
+	var msg textMsg
+	err := NewDecoder(bytes.NewReader(input), syncMLTags, CodeSpace{}).Decode(&msg)
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	assert.Equal(t, textMsg{Data: "déjà"}, msg)
+}
+
+func TestDecoderStatefulCharset(t *testing.T) {
+	// "日本" in ISO-2022-JP (MIBenum 39), split in two strings after "日": the second
+	// string is still in JIS X 0208 until its closing escape sequence
+	input := []byte{0x03, 0x01, 0x27, 0x00, 0x6D, 0x4F,
+		0x03, 0x1B, '$', 'B', 0x46, 0x7C, 0x00,
+		0x03, 0x4B, 0x5C, 0x1B, '(', 'B', 0x00,
+		0x01, 0x01}
+
+	var msg textMsg
+	err := NewDecoder(bytes.NewReader(input), syncMLTags, CodeSpace{}).Decode(&msg)
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	assert.Equal(t, textMsg{Data: "日本"}, msg)
+}
+
+func TestDecoderStatefulCharsetTable(t *testing.T) {
+	// in ISO-2022-JP, an inline string left in JIS X 0208 by "\x1B$B日", then a reference
+	// to "abc" in the string table, which is converted from ASCII as it starts
+	input := []byte{0x03, 0x01, 0x27, 0x04, 'a', 'b', 'c', 0x00, 0x6D, 0x4F,
+		0x03, 0x1B, '$', 'B', 0x46, 0x7C, 0x00,
+		0x83, 0x00,
+		0x01, 0x01}
+
+	var msg textMsg
+	err := NewDecoder(bytes.NewReader(input), syncMLTags, CodeSpace{}).Decode(&msg)
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	assert.Equal(t, textMsg{Data: "日abc"}, msg)
+}
+
+func TestDecoderUTF16(t *testing.T) {
+	// "aé" in UTF-16BE (MIBenum 1013) as an inline string: the high byte of each
+	// character is 0x00, and the string ends with a 0x00 0x00 code unit
+	input := []byte{0x03, 0x01, 0x87, 0x75, 0x00, 0x6D, 0x4F,
+		0x03, 0x00, 'a', 0x00, 0xE9, 0x00, 0x00,
+		0x01, 0x01}
+
+	var msg textMsg
+	err := NewDecoder(bytes.NewReader(input), syncMLTags, CodeSpace{}).Decode(&msg)
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	assert.Equal(t, textMsg{Data: "aé"}, msg)
+
+	msg = textMsg{}
+	err = NewBytesDecoder(input, syncMLTags, CodeSpace{}).Decode(&msg)
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	assert.Equal(t, textMsg{Data: "aé"}, msg)
+
+	// the same string in UTF-16LE (MIBenum 1014), referenced in the string table: the
+	// 0x00 0x00 spanning 'a' and 'é' is not on a code unit boundary
+	input = []byte{0x03, 0x01, 0x87, 0x76, 0x06, 'a', 0x00, 0xE9, 0x00, 0x00, 0x00,
+		0x6D, 0x4F, 0x83, 0x00, 0x01, 0x01}
+	msg = textMsg{}
+	err = NewDecoder(bytes.NewReader(input), syncMLTags, CodeSpace{}).Decode(&msg)
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	assert.Equal(t, textMsg{Data: "aé"}, msg)
+}
@@ -3,37 +3,67 @@ package wbxml
 import (
 	"fmt"
 	"io"
+	"math"
 )
 
+// read reads from the stream of d, keeping track of the offset and of the raw bytes.
+func (d *Decoder) read(p []byte) (int, error) {
+	n, err := d.r.Read(p)
+	d.offset += n
+	if d.raw != nil {
+		d.raw.Write(p[:n])
+	}
+	return n, err
+}
+
+// readerFunc is an io.Reader calling the function itself.
+type readerFunc func(p []byte) (int, error)
+
+func (f readerFunc) Read(p []byte) (int, error) {
+	return f(p)
+}
+
 func readByte(d *Decoder) (byte, error) {
 	var b [1]byte
-	n, err := d.r.Read(b[:])
-	d.offset += n
+	_, err := d.read(b[:])
 	return b[0], err
 }
 
-func rreadByte(d io.Reader) (byte, error) {
+// ReadByte reads a single byte from r. It returns io.EOF if r has no more data.
+func ReadByte(r io.Reader) (byte, error) {
 	var b [1]byte
-	_, err := d.Read(b[:])
+	_, err := io.ReadFull(r, b[:])
 	return b[0], err
 }
 
-func writeByte(e *Encoder, b byte) error {
+// WriteByte writes the single byte b to w.
+func WriteByte(w io.Writer, b byte) error {
 	buf := [1]byte{b}
-	_, err := e.w.Write(buf[:])
+	_, err := w.Write(buf[:])
 	return err
 }
 
+func writeByte(e *Encoder, b byte) error {
+	err := WriteByte(e.w, b)
+	if err == nil {
+		e.offset++
+	}
+	return e.setErr(err)
+}
+
 // MbUint read a multibyte encoded integer, as specified by WBXML.
 func MbUint(r io.Reader, max int) (uint64, error) {
 	var result uint64
 
 	for i := 0; i < max; i++ {
-		b, err := rreadByte(r)
+		b, err := ReadByte(r)
 		if err != nil {
 			return 0, err
 		}
 
+		if result > math.MaxUint64>>7 {
+			return 0, fmt.Errorf("multi-byte integer overflows 64 bits")
+		}
 		result = (result << 7) | (uint64(b) & 0x7f)
 
 		if b&0x80 == 0x00 { // final byte
@@ -51,7 +81,16 @@ func mbUint(d *Decoder, max int) (uint64, error) {
 		if err != nil {
 			return 0, err
 		}
+		if i == 0 && b == 0x80 {
+			if d.Strict {
+				return 0, fmt.Errorf("multi-byte integer is not in its minimal form")
+			}
+			d.warn("multi-byte integer is not in its minimal form")
+		}
 
+		if result > math.MaxUint64>>7 {
+			return 0, fmt.Errorf("multi-byte integer overflows 64 bits")
+		}
 		result = (result << 7) | (uint64(b) & 0x7f)
 
 		if b&0x80 == 0x00 { // final byte
@@ -61,11 +100,26 @@ func mbUint(d *Decoder, max int) (uint64, error) {
 	return 0, fmt.Errorf("multi-byte integer is longer than expected %d bytes", max)
 }
 
+const (
+	defaultMbUintBytes = 4  // 28 bits, a full 32 bits integer needs 5 bytes
+	maxMbUintBytes     = 10 // bytes needed by a 64 bits integer
+)
+
 func mbUint32(d *Decoder) (uint32, error) {
-	u, err := mbUint(d, 4)
+	max := defaultMbUintBytes
+	if d.MaxMbUintBytes > max {
+		max = d.MaxMbUintBytes
+	}
+	if max > maxMbUintBytes {
+		max = maxMbUintBytes
+	}
+	u, err := mbUint(d, max)
 	if err != nil {
 		return 0, err
 	}
+	if u > math.MaxUint32 {
+		return 0, fmt.Errorf("multi-byte integer %d does not fit in 32 bits", u)
+	}
 	return uint32(u), nil
 }
 
@@ -94,16 +148,22 @@ func writeMbUint32(d *Encoder, v uint32) error {
 }
 
 func readString(d *Decoder) ([]byte, error) {
+	if d.src != nil {
+		return aliasString(d)
+	}
 	result := make([]byte, 0, 8)
 	for {
 		b, err := readByte(d)
 		if err != nil {
 			return nil, err
 		}
-		if b == 0 {
+		if b == 0 && !d.wide {
 			return result, nil
 		}
 		result = append(result, b)
+		if n := len(result); d.wide && n%2 == 0 && result[n-2] == 0 && result[n-1] == 0 {
+			return result[:n-2], nil
+		}
 	}
 }
 
@@ -118,25 +178,76 @@ func writeString(d *Encoder, str []byte) error {
 }
 
 func readSlice(d *Decoder, length uint32) ([]byte, error) {
+	if d.src != nil {
+		return aliasSlice(d, length)
+	}
 	result := make([]byte, length)
-	n, err := d.r.Read(result)
+	n, err := d.read(result)
 	if err != nil {
 		return nil, err
 	}
-	d.offset += n
 	if uint32(n) != length {
 		return result[:n], fmt.Errorf("expected %d bytes, got %d", length, n)
 	}
 	return result, nil
 }
 
+// aliasString is readString for a decoder created by NewBytesDecoder, returning a slice
+// of its source.
+func aliasString(d *Decoder) ([]byte, error) {
+	pos := len(d.srcData) - d.src.Len()
+	end := d.stringEnd(d.srcData[pos:])
+	if end < 0 {
+		d.skip(len(d.srcData) - pos)
+		return nil, io.EOF
+	}
+	result := d.srcData[pos : pos+end : pos+end]
+	if d.wide {
+		d.skip(end + 2)
+	} else {
+		d.skip(end + 1)
+	}
+	return result, nil
+}
+
+// aliasSlice is readSlice for a decoder created by NewBytesDecoder, returning a slice of
+// its source.
+func aliasSlice(d *Decoder, length uint32) ([]byte, error) {
+	pos := len(d.srcData) - d.src.Len()
+	if pos == len(d.srcData) && length > 0 {
+		return nil, io.EOF
+	}
+	end := len(d.srcData)
+	if uint64(length) < uint64(end-pos) {
+		end = pos + int(length)
+	}
+	result := d.srcData[pos:end:end]
+	d.skip(end - pos)
+	if uint32(len(result)) != length {
+		return result, fmt.Errorf("expected %d bytes, got %d", length, len(result))
+	}
+	return result, nil
+}
+
+// skip advances the source of a decoder created by NewBytesDecoder by n bytes, as if
+// they were read.
+func (d *Decoder) skip(n int) {
+	pos := len(d.srcData) - d.src.Len()
+	d.src.Seek(int64(n), io.SeekCurrent)
+	d.offset += n
+	if d.raw != nil {
+		d.raw.Write(d.srcData[pos : pos+n])
+	}
+}
+
 func writeSlice(d *Encoder, buf []byte) error {
 	n, err := d.w.Write(buf)
+	d.offset += n
 	if err != nil {
-		return err
+		return d.setErr(err)
 	}
 	if n != len(buf) {
-		return fmt.Errorf("expected %d bytes, got %d", len(buf), n)
+		return d.setErr(fmt.Errorf("expected %d bytes, got %d", len(buf), n))
 	}
 	return nil
 }
@@ -152,3 +263,24 @@ func writeOpaque(d *Encoder, buf Opaque) error {
 	}
 	return writeSlice(d, buf)
 }
+
+func writeOpaqueReader(d *Encoder, r OpaqueReader) error {
+	err := writeByte(d, gloOpaque)
+	if err != nil {
+		return err
+	}
+	length := r.N
+	err = writeMbUint32(d, uint32(length))
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(d.w, r)
+	d.offset += int(n)
+	if err != nil {
+		return d.setErr(err)
+	}
+	if n != length {
+		return d.setErr(fmt.Errorf("expected %d bytes, got %d", length, n))
+	}
+	return nil
+}
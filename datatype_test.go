@@ -2,6 +2,7 @@ package wbxml
 
 import (
 	"bytes"
+	"io"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -48,3 +49,72 @@ func TestEncodeMultibyteInteger(t *testing.T) {
 		assert.Equal(t, test.data, w.Bytes(), "case %d", testID)
 	}
 }
+
+func TestDecodeMultibyteIntegerStrict(t *testing.T) {
+	for testID, test := range multiByteExamples {
+		result, err := mbUint(&Decoder{r: bytes.NewReader(test.data), Strict: true}, 8)
+
+		if err != nil {
+			t.Errorf("case %d: unexpected error: %s", testID, err)
+			continue
+		}
+
+		if result != test.mbuint {
+			t.Errorf("case %d: expected %d, got %d", testID, test.mbuint, result)
+		}
+	}
+
+	nonMinimal := []byte{0x80, 0x00}
+
+	result, err := mbUint(&Decoder{r: bytes.NewReader(nonMinimal)}, 8)
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	if result != 0 {
+		t.Errorf("expected 0, got %d", result)
+	}
+
+	_, err = mbUint(&Decoder{r: bytes.NewReader(nonMinimal), Strict: true}, 8)
+	if err == nil {
+		t.Errorf("expected an error for a non minimal integer")
+	}
+}
+
+func TestDecodeMultibyteIntegerOverflow(t *testing.T) {
+	// 2<<63 wraps to 0 in 64 bits
+	input := []byte{0x82, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x00}
+	_, err := mbUint(&Decoder{r: bytes.NewReader(input)}, 10)
+	if err == nil {
+		t.Errorf("expected an error for an integer overflowing 64 bits")
+	}
+	_, err = MbUint(bytes.NewReader(input), 10)
+	if err == nil {
+		t.Errorf("expected an error for an integer overflowing 64 bits")
+	}
+
+	_, err = mbUint32(&Decoder{r: bytes.NewReader(input), MaxMbUintBytes: 10})
+	if err == nil {
+		t.Errorf("expected an error for an integer overflowing 64 bits")
+	}
+}
+
+func TestReadWriteByte(t *testing.T) {
+	w := bytes.NewBuffer(nil)
+	for _, b := range []byte{0x03, 0x00, 0xFF} {
+		err := WriteByte(w, b)
+		if err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+	}
+	assert.Equal(t, []byte{0x03, 0x00, 0xFF}, w.Bytes())
+
+	for _, expected := range []byte{0x03, 0x00, 0xFF} {
+		b, err := ReadByte(w)
+		if err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		assert.Equal(t, expected, b)
+	}
+	_, err := ReadByte(w)
+	assert.Equal(t, io.EOF, err)
+}
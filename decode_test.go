@@ -3,9 +3,15 @@ package wbxml
 import (
 	"bytes"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"math/big"
+	"runtime"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -84,33 +90,40 @@ var tagSpaceExamples = []struct {
 
 var tokensExamples = [][]Token{
 	[]Token{
-		StartElement{Name: "XYZ", Content: true},
-		StartElement{Name: "CARD", Content: true},
+		StartElement{Name: "XYZ", Content: true, Offset: 4, StartOffset: 4, EndOffset: 5},
+		StartElement{Name: "CARD", Content: true, Offset: 5, StartOffset: 5, EndOffset: 6},
 		CharData(" X & Y"),
-		StartElement{Name: "BR"},
-		EndElement{Name: "BR"},
+		StartElement{Name: "BR", Offset: 14, StartOffset: 14, EndOffset: 15},
+		EndElement{Name: "BR", Offset: 15, StartOffset: 15, EndOffset: 15},
 		CharData(" X\u00A0=\u00A01 "),
-		EndElement{Name: "CARD"},
-		EndElement{Name: "XYZ"},
+		EndElement{Name: "CARD", Offset: 27, StartOffset: 26, EndOffset: 27},
+		EndElement{Name: "XYZ", Offset: 28, StartOffset: 27, EndOffset: 28},
 		nil,
 	},
 	[]Token{
-		StartElement{Name: "XYZ", Content: true},
+		StartElement{Name: "XYZ", Content: true, Offset: 22, StartOffset: 22, EndOffset: 23},
 		StartElement{
 			Name:    "CARD",
 			Content: true,
 			Attr: []Attr{
 				Attr{"NAME", "abc"},
 				Attr{"STYLE", ""},
-			}},
+			},
+			Offset:      28,
+			StartOffset: 23,
+			EndOffset:   29,
+		},
 		StartElement{
 			Name: "DO",
 			Attr: []Attr{
 				Attr{"TYPE", "ACCEPT"},
 				Attr{"URL", "xyz.org/s"},
 			},
+			Offset:      43,
+			StartOffset: 29,
+			EndOffset:   44,
 		},
-		EndElement{Name: "DO"},
+		EndElement{Name: "DO", Offset: 44, StartOffset: 44, EndOffset: 44},
 		CharData(" Enter name: "),
 		StartElement{
 			Name: "INPUT",
@@ -118,10 +131,13 @@ var tokensExamples = [][]Token{
 				Attr{"TYPE", ""},
 				Attr{"KEY", "N"},
 			},
+			Offset:      52,
+			StartOffset: 46,
+			EndOffset:   53,
 		},
-		EndElement{Name: "INPUT"},
-		EndElement{Name: "CARD"},
-		EndElement{Name: "XYZ"},
+		EndElement{Name: "INPUT", Offset: 53, StartOffset: 53, EndOffset: 53},
+		EndElement{Name: "CARD", Offset: 54, StartOffset: 53, EndOffset: 54},
+		EndElement{Name: "XYZ", Offset: 55, StartOffset: 54, EndOffset: 55},
 		nil,
 	},
 }
@@ -408,3 +424,2256 @@ func TestDecoderDecodeWithPointer(t *testing.T) {
 	}
 	assert.Equal(t, expected, m)
 }
+
+type msg5 struct {
+	SyncHdr header5
+}
+
+type header5 struct {
+	Meta meta5
+}
+
+type meta5 struct {
+	EMI *rawElement
+}
+
+// rawElement keeps the undecoded bytes of an element.
+type rawElement struct {
+	Sign []byte
+	Raw  []byte
+}
+
+func (e *rawElement) UnmarshalWBXML(d *Decoder, start *StartElement) error {
+	raw, err := d.RawElement(start)
+	e.Raw = raw
+	return err
+}
+
+func TestDecoderDecodeWithPointerUnmarshaler(t *testing.T) {
+	input := "030000030212016d6c7103312e32000172036d326d2f312e32000165035337654e6500015b025e016757037463703a2f2f4163637565696c2e4e6f6349642e616d6d2e66720001016e570367646f3a39393030355a313333382d32313137380001015a000146000849c34830460221009a9f724f5146b6e26a357b4b53221388beef1a95c6f4ba9f0572d5854f023e540221008dd885e08828436c6e2b08fbb816d359791b9d8cb1ca6334f8201fee130909a901010001010000016b694b0201015c025d014c0201014a0350757400014f028374010152010101"
+	data, err := hex.DecodeString(input)
+	if err != nil {
+		panic(err)
+	}
+	d := NewDecoder(bytes.NewReader(data), syncMLTags, CodeSpace{})
+
+	var m msg5
+	err = d.Decode(&m)
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	emi := m.SyncHdr.Meta.EMI
+	if emi == nil {
+		t.Fatalf("expected EMI to be allocated")
+	}
+	assert.Nil(t, emi.Sign)
+	// SWITCH_PAGE 8, Sign with an opaque of 0x48 bytes, END of Sign and of EMI
+	if len(emi.Raw) != 5+0x48+2 {
+		t.Fatalf("expected %d raw bytes, got %d", 5+0x48+2, len(emi.Raw))
+	}
+	assert.Equal(t, []byte{0x00, 0x08, 0x49, 0xC3, 0x48}, emi.Raw[:5])
+	assert.Equal(t, []byte{0x01, 0x01}, emi.Raw[5+0x48:])
+
+	// pointer to a nil pointer to an Unmarshaler
+	d = NewDecoder(bytes.NewReader([]byte{0x03, 0x01, 0x6A, 0x00, 0x4F, 0x03, 'a', 'b', 0x00, 0x01}), syncMLTags, CodeSpace{})
+	var elt *rawElement
+	err = d.Decode(&elt)
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	assert.Equal(t, &rawElement{Raw: []byte{0x03, 'a', 'b', 0x00, 0x01}}, elt)
+}
+
+type dataMsg struct {
+	Data []byte
+}
+
+type opaqueDataMsg struct {
+	Data []byte `wbxml:",opaque"`
+}
+
+// <SyncML><Data>500</Data></SyncML>
+var numericDataInput = []byte{0x03, 0x01, 0x6A, 0x00, 0x6D, 0x4F, 0x03, '5', '0', '0', 0x00, 0x01, 0x01}
+
+func TestDecoderDecodeNumericCharDataToBytes(t *testing.T) {
+	d := NewDecoder(bytes.NewReader(numericDataInput), syncMLTags, CodeSpace{})
+
+	var m dataMsg
+	err := d.Decode(&m)
+
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	assert.Equal(t, dataMsg{Data: []byte("500")}, m)
+}
+
+func TestDecoderDecodeOpaqueTag(t *testing.T) {
+	d := NewDecoder(bytes.NewReader(numericDataInput), syncMLTags, CodeSpace{})
+
+	var m opaqueDataMsg
+	err := d.Decode(&m)
+
+	if err == nil {
+		t.Errorf("expected an error, got %v", m)
+	}
+
+	// <SyncML><Data>OPAQUE(500)</Data></SyncML>
+	input := []byte{0x03, 0x01, 0x6A, 0x00, 0x6D, 0x4F, 0xC3, 0x03, '5', '0', '0', 0x01, 0x01}
+	d = NewDecoder(bytes.NewReader(input), syncMLTags, CodeSpace{})
+
+	m = opaqueDataMsg{}
+	err = d.Decode(&m)
+
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	assert.Equal(t, opaqueDataMsg{Data: []byte("500")}, m)
+}
+
+type doType int
+
+const (
+	doPrev doType = iota
+	doAccept
+)
+
+type wmlDeck struct {
+	CARD wmlCard
+}
+
+type wmlCard struct {
+	NAME string `wbxml:",attr"`
+	DO   wmlDo
+}
+
+type wmlDo struct {
+	TYPE doType `wbxml:",attr"`
+	URL  string `wbxml:",attr"`
+}
+
+func TestDecoderDecodeAttrEnum(t *testing.T) {
+	space := tagSpaceExamples[1]
+	d := NewDecoder(bytes.NewReader(decodingExamples[1]), space.tags, space.attrs)
+	d.RegisterEnum(doPrev, map[string]int64{
+		"PREV":   int64(doPrev),
+		"ACCEPT": int64(doAccept),
+	})
+
+	var deck wmlDeck
+	err := d.Decode(&deck)
+
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	expected := wmlDeck{
+		CARD: wmlCard{
+			NAME: "abc",
+			DO:   wmlDo{TYPE: doAccept, URL: "xyz.org/s"},
+		},
+	}
+	assert.Equal(t, expected, deck)
+
+	err = d.RegisterEnum("PREV", map[string]int64{"PREV": 0})
+	assert.NotNil(t, err)
+
+	// ACCEPT does not fit in an int8
+	type narrowType int8
+	var narrow struct {
+		CARD struct {
+			DO struct {
+				TYPE narrowType `wbxml:",attr"`
+			}
+		}
+	}
+	d = NewDecoder(bytes.NewReader(decodingExamples[1]), space.tags, space.attrs)
+	err = d.RegisterEnum(narrowType(0), map[string]int64{"ACCEPT": 300})
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	err = d.Decode(&narrow)
+	assert.NotNil(t, err)
+
+	var unexported struct {
+		CARD struct {
+			DO struct {
+				typ doType `wbxml:"TYPE,attr"`
+			}
+		}
+	}
+	d = NewDecoder(bytes.NewReader(decodingExamples[1]), space.tags, space.attrs)
+	err = d.RegisterEnum(doPrev, map[string]int64{"ACCEPT": int64(doAccept)})
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	err = d.Decode(&unexported)
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	assert.Equal(t, doPrev, unexported.CARD.DO.typ)
+}
+
+type wmlInput struct {
+	Name string `wbxml:"NAME,attr"`
+	Key  int32  `wbxml:"KEY,attr"`
+}
+
+// INPUT with NAME="abc" KEY="12"
+var wmlInputInput = []byte{0x86, 0x09, 0x03, 'a', 'b', 'c', 0x00, 0x0A, 0x03, '1', '2', 0x00, 0x01}
+
+func TestDecoderDecodeNamedAttrs(t *testing.T) {
+	space := tagSpaceExamples[1]
+	input := append([]byte{0x01, 0x01, 0x6A, 0x00}, wmlInputInput...)
+
+	var v wmlInput
+	err := NewDecoder(bytes.NewReader(input), space.tags, space.attrs).Decode(&v)
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	assert.Equal(t, wmlInput{Name: "abc", Key: 12}, v)
+
+	var u struct {
+		Key uint8 `wbxml:"KEY,attr"`
+	}
+	input[len(input)-4] = '-'
+	err = NewDecoder(bytes.NewReader(input), space.tags, space.attrs).Decode(&u)
+	if err == nil {
+		t.Errorf("expected an error for a negative unsigned attribute")
+	}
+}
+
+func TestDecoderSkipLeading(t *testing.T) {
+	input := append([]byte{0xEF}, syncMLInput...)
+
+	d := NewDecoder(bytes.NewReader(input), syncMLTags, CodeSpace{})
+	var m msg
+	err := d.Decode(&m)
+	if err == nil {
+		t.Fatalf("expected an error about the leading byte")
+	}
+	assert.Equal(t, "position 1: leading byte 0xEF is not a known WBXML version", err.Error())
+
+	d = NewDecoder(bytes.NewReader(input), syncMLTags, CodeSpace{})
+	d.SkipLeading = true
+	m = msg{}
+	err = d.Decode(&m)
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	assert.Equal(t, "S7eNe", m.SyncHdr.SessionID)
+}
+
+func TestDecoderStream(t *testing.T) {
+	var expected []Token
+	d := NewDecoder(bytes.NewReader(syncMLInput), syncMLTags, CodeSpace{})
+	for {
+		tok, err := d.Token()
+		if err != nil {
+			break
+		}
+		expected = append(expected, tok)
+	}
+
+	ch := make(chan Token, 4)
+	errc := make(chan error, 1)
+	d = NewDecoder(bytes.NewReader(syncMLInput), syncMLTags, CodeSpace{})
+	go func() {
+		errc <- d.Stream(ch)
+		close(ch)
+	}()
+
+	var result []Token
+	for tok := range ch {
+		result = append(result, tok)
+	}
+	if err := <-errc; err != io.EOF {
+		t.Errorf("expected io.EOF, got %v", err)
+	}
+	assert.Equal(t, expected, result)
+}
+
+func TestDecoderGoroutines(t *testing.T) {
+	before := runtime.NumGoroutine()
+	for i := 0; i < 100; i++ {
+		var m msg
+		d := NewDecoder(bytes.NewReader(syncMLInput), syncMLTags, CodeSpace{})
+		err := d.Decode(&m)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		toks, err := NewDecoder(bytes.NewReader(syncMLInput), syncMLTags, CodeSpace{}).DecodeAll()
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		err = NewTokenDecoder(toks).Decode(&m)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+
+	// the goroutines may still be returning
+	after := runtime.NumGoroutine()
+	for i := 0; i < 100 && after > before; i++ {
+		time.Sleep(time.Millisecond)
+		after = runtime.NumGoroutine()
+	}
+	if after > before {
+		t.Errorf("%d goroutines left by 300 decodes", after-before)
+	}
+}
+
+func TestDecoderStrictSwitchPage(t *testing.T) {
+	tests := []struct {
+		input []byte
+		tags  CodeSpace
+		attrs CodeSpace
+		msg   string
+	}{
+		{
+			// <SyncML> SWITCH_PAGE 5 <Add/> </SyncML>
+			input: []byte{0x03, 0x01, 0x6A, 0x00, 0x6D, 0x00, 0x05, 0x05, 0x01},
+			tags:  syncMLTags,
+			attrs: CodeSpace{},
+			msg:   "SWITCH_PAGE to unknown tag page 5",
+		},
+		{
+			// <DO SWITCH_PAGE 3 TYPE="" />
+			input: []byte{0x03, 0x01, 0x6A, 0x00, 0x88, 0x00, 0x03, 0x06, 0x01},
+			tags:  tagSpaceExamples[1].tags,
+			attrs: tagSpaceExamples[1].attrs,
+			msg:   "SWITCH_PAGE to unknown attribute page 3",
+		},
+	}
+
+	for testID, test := range tests {
+		d := NewDecoder(bytes.NewReader(test.input), test.tags, test.attrs)
+		d.Strict = true
+
+		var err error
+		for err == nil {
+			_, err = d.Token()
+		}
+		serr, ok := err.(*SyntaxError)
+		if !ok {
+			t.Errorf("case %d: expected a SyntaxError, got %v", testID, err)
+			continue
+		}
+		assert.Equal(t, test.msg, serr.Msg, "case %d", testID)
+		assert.Equal(t, 7, serr.Offset, "case %d", testID)
+	}
+}
+
+func TestDecoderUnknownAttr(t *testing.T) {
+	space := tagSpaceExamples[1]
+	// CARD with the unknown attribute 0x07="a"
+	input := []byte{0x01, 0x01, 0x6A, 0x00, 0x85, 0x07, 0x03, 'a', 0x00, 0x01}
+
+	d := NewDecoder(bytes.NewReader(input), space.tags, space.attrs)
+	_, err := d.DecodeAll()
+	serr, ok := err.(*SyntaxError)
+	if !ok {
+		t.Fatalf("expected a SyntaxError, got %v", err)
+	}
+	assert.Equal(t, "Unknown code 7 in page 0", serr.Msg)
+
+	d = NewDecoder(bytes.NewReader(input), space.tags, space.attrs)
+	d.LenientAttrs = true
+	toks, err := d.DecodeAll()
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	assert.Equal(t, []Attr{{"Unknown_0x07", "a"}}, toks[0].(StartElement).Attr)
+	assert.Equal(t, []Warning{{Msg: "unknown attribute code 0x07 in page 0", Offset: 6}}, d.Warnings)
+}
+
+func TestDecoderTrailingBytes(t *testing.T) {
+	input := append(append([]byte{}, syncMLInput...), 0xAB, 0xCD)
+
+	for _, strict := range []bool{false, true} {
+		d := NewDecoder(bytes.NewReader(input), syncMLTags, CodeSpace{})
+		d.Strict = strict
+
+		var err error
+		var tok Token
+		count := 0
+		for err == nil {
+			tok, err = d.Token()
+			if tok != nil {
+				count++
+			}
+		}
+		assert.Equal(t, 54, count, "strict %v", strict)
+		if !strict {
+			assert.Equal(t, io.EOF, err)
+			continue
+		}
+		serr, ok := err.(*SyntaxError)
+		if !ok {
+			t.Errorf("expected a SyntaxError, got %v", err)
+			continue
+		}
+		assert.Equal(t, "unexpected byte 0xAB after the root element", serr.Msg)
+	}
+}
+
+type bigDataMsg struct {
+	Data *big.Int
+}
+
+func TestDecoderDecodeBigInt(t *testing.T) {
+	digits := "1234567890123456789012345678901234567890"
+	input := []byte{0x03, 0x01, 0x6A, 0x00, 0x6D, 0x4F, 0x03}
+	input = append(input, digits...)
+	input = append(input, 0x00, 0x01, 0x01)
+	d := NewDecoder(bytes.NewReader(input), syncMLTags, CodeSpace{})
+
+	var m bigDataMsg
+	err := d.Decode(&m)
+
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	expected, _ := new(big.Int).SetString(digits, 10)
+	assert.Equal(t, expected.String(), m.Data.String())
+
+	input = []byte{0x03, 0x01, 0x6A, 0x00, 0x6D, 0x4F, 0x03, '1', ',', '2', '3', '4', ',', '5', '6', '7', 0x00, 0x01, 0x01}
+	d = NewDecoder(bytes.NewReader(input), syncMLTags, CodeSpace{})
+	d.NumberCleaner = func(s string) string {
+		return strings.Replace(s, ",", "", -1)
+	}
+	m = bigDataMsg{}
+	err = d.Decode(&m)
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	assert.Equal(t, "1234567", m.Data.String())
+
+	// <Data/> without content
+	input = []byte{0x03, 0x01, 0x6A, 0x00, 0x6D, 0x0F, 0x01}
+	m = bigDataMsg{}
+	err = NewDecoder(bytes.NewReader(input), syncMLTags, CodeSpace{}).Decode(&m)
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	assert.Equal(t, "0", m.Data.String())
+}
+
+func TestDecoderRawElement(t *testing.T) {
+	d := NewDecoder(bytes.NewReader(syncMLInput), syncMLTags, CodeSpace{})
+
+	for {
+		tok, err := d.Token()
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if st, ok := tok.(StartElement); ok && st.Name == "Meta" {
+			break
+		}
+	}
+	raw, err := d.RawElement(&StartElement{Name: "Meta"})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// from SWITCH_PAGE 1 <EMI> to the END of Meta
+	start := bytes.Index(syncMLInput, []byte{0x5a, 0x00, 0x01, 0x46}) + 1
+	end := bytes.Index(syncMLInput, []byte{0x01, 0x01, 0x00, 0x01, 0x01}) + 5
+	assert.Equal(t, syncMLInput[start:end], raw)
+
+	tok, err := d.Token()
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	assert.Equal(t, "SyncHdr", tok.(EndElement).Name)
+}
+
+func TestDecoderEntityCodePoint(t *testing.T) {
+	tests := []struct {
+		entity []byte
+		text   string
+		valid  bool
+	}{
+		{[]byte{0x87, 0xEC, 0x00}, "a\U0001F600", true}, // U+1F600
+		{[]byte{0x83, 0xB0, 0x00}, "a\uFFFD", false},    // surrogate U+D800
+		{[]byte{0xC4, 0x80, 0x00}, "a\uFFFD", false},    // 0x110000
+	}
+
+	for testID, test := range tests {
+		// <SyncML>"a" ENTITY</SyncML>
+		input := []byte{0x03, 0x01, 0x6A, 0x00, 0x6D, 0x03, 'a', 0x00, 0x02}
+		input = append(append(input, test.entity...), 0x01)
+
+		for _, strict := range []bool{false, true} {
+			d := NewDecoder(bytes.NewReader(input), syncMLTags, CodeSpace{})
+			d.Strict = strict
+
+			d.Token()
+			tok, err := d.Token()
+			if strict && !test.valid {
+				if _, ok := err.(*SyntaxError); !ok {
+					t.Errorf("case %d: expected a SyntaxError, got %v, %v", testID, tok, err)
+				}
+				continue
+			}
+			if err != nil {
+				t.Errorf("case %d: unexpected error: %s", testID, err)
+				continue
+			}
+			assert.Equal(t, CharData(test.text), tok, "case %d, strict %v", testID, strict)
+		}
+	}
+}
+
+func TestDecoderDecodeAllAndReplay(t *testing.T) {
+	var expected msg
+	err := NewDecoder(bytes.NewReader(syncMLInput), syncMLTags, CodeSpace{}).Decode(&expected)
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	var expected3 msg3
+	err = NewDecoder(bytes.NewReader(syncMLInput), syncMLTags, CodeSpace{}).Decode(&expected3)
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+
+	toks, err := NewDecoder(bytes.NewReader(syncMLInput), syncMLTags, CodeSpace{}).DecodeAll()
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	assert.Equal(t, 54, len(toks))
+
+	var m msg
+	err = NewTokenDecoder(toks).Decode(&m)
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	assert.Equal(t, expected, m)
+
+	var m3 msg3
+	err = NewTokenDecoder(toks).Decode(&m3)
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	assert.Equal(t, expected3, m3)
+}
+
+type lazyEndpoint struct{}
+
+func (e *lazyEndpoint) UnmarshalWBXML(d *Decoder, start *StartElement) error {
+	// returns without consuming LocURI nor the end element
+	return nil
+}
+
+type lazyHeader struct {
+	Source lazyEndpoint
+}
+
+type lazyMsg struct {
+	SyncHdr lazyHeader
+}
+
+func TestDecoderUnmarshalerUnderConsuming(t *testing.T) {
+	d := NewDecoder(bytes.NewReader(syncMLInput), syncMLTags, CodeSpace{})
+
+	var m lazyMsg
+	err := d.Decode(&m)
+
+	if err == nil {
+		t.Fatalf("expected an error")
+	}
+	assert.Equal(t, "*wbxml.lazyEndpoint.UnmarshalWBXML did not stop at the end element Source", err.Error())
+}
+
+func TestDecoderUnmarshalerPeekedStart(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		passed bool
+		err    string
+	}{
+		{"nil start", false, ""},
+		{"peeked start", true, "*wbxml.body2.UnmarshalWBXML did not stop at the end element SyncBody"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			d := NewDecoder(bytes.NewReader(syncMLInput), syncMLTags, CodeSpace{})
+			if _, err := d.Token(); err != nil {
+				t.Fatal(err)
+			}
+			var hdr header
+			if err := d.DecodeElement(&hdr, nil); err != nil {
+				t.Fatal(err)
+			}
+			tok, err := d.Peek()
+			if err != nil {
+				t.Fatal(err)
+			}
+			st := tok.(StartElement)
+			var start *StartElement
+			if tc.passed {
+				start = &st
+			}
+
+			var b body2
+			err = d.DecodeElement(&b, start)
+
+			if tc.err == "" {
+				if err != nil {
+					t.Errorf("unexpected error: %s", err)
+				}
+				assert.Equal(t, 2, len(b))
+				return
+			}
+			if err == nil {
+				t.Fatalf("expected an error")
+			}
+			assert.Equal(t, tc.err, err.Error())
+		})
+	}
+}
+
+type wmlTextDeck struct {
+	CARD wmlTextCard
+}
+
+type wmlTextCard struct {
+	NAME string `wbxml:",attr"`
+	Text string `wbxml:",chardata"`
+}
+
+func TestDecoderDecodeCharDataField(t *testing.T) {
+	space := tagSpaceExamples[1]
+	d := NewDecoder(bytes.NewReader(decodingExamples[1]), space.tags, space.attrs)
+
+	var deck wmlTextDeck
+	err := d.Decode(&deck)
+
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	expected := wmlTextDeck{
+		CARD: wmlTextCard{NAME: "abc", Text: " Enter name: "},
+	}
+	assert.Equal(t, expected, deck)
+}
+
+func TestDecoderStreamOpaque(t *testing.T) {
+	payload := bytes.Repeat([]byte{0x00, 0x01, 0xFE, 0xFF}, 1<<18)
+
+	doc := bytes.NewBuffer(nil)
+	e := NewEncoder(doc, syncMLTags, CodeSpace{})
+	err := e.EncodeHeader(Header{Version: 3, PublicID: 1, Charset: 106})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	for _, tok := range []Token{
+		StartElement{Name: "SyncML", Content: true},
+		StartElement{Name: "Data", Content: true},
+		Opaque(payload),
+		EndElement{Name: "Data"},
+		StartElement{Name: "Data", Content: true},
+		Opaque(payload),
+		EndElement{Name: "Data"},
+		EndElement{Name: "SyncML"},
+	} {
+		err := e.EncodeToken(tok)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+
+	// count the bytes read from the document, to check that the opaque is not buffered
+	read := 0
+	r := readerFunc(func(p []byte) (int, error) {
+		n, err := doc.Read(p)
+		read += n
+		return n, err
+	})
+	d := NewDecoder(r, syncMLTags, CodeSpace{})
+	d.StreamOpaque = true
+
+	var opaques int
+	for {
+		before := read
+		tok, err := d.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		opaque, ok := tok.(OpaqueReader)
+		if !ok {
+			continue
+		}
+		opaques++
+		assert.Equal(t, int64(len(payload)), opaque.N)
+		if read-before >= len(payload) {
+			t.Errorf("%d bytes read to return an opaque of %d bytes", read-before, len(payload))
+		}
+		if opaques == 2 {
+			data, err := ioutil.ReadAll(opaque)
+			if err != nil {
+				t.Errorf("unexpected error: %s", err)
+			}
+			assert.Equal(t, payload, data)
+			continue
+		}
+
+		// read the start of the first opaque, the rest is skipped by the next call to Token
+		before = read
+		data := make([]byte, 4096)
+		_, err = io.ReadFull(opaque, data)
+		if err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		assert.Equal(t, payload[:4096], data)
+		assert.Equal(t, int64(len(payload)-4096), opaque.N)
+		assert.Equal(t, before+4096, read)
+
+		tok, err = d.Token()
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		assert.Equal(t, "Data", tok.(EndElement).Name)
+	}
+	assert.Equal(t, 2, opaques)
+}
+
+type opaqueMsg struct {
+	Data []byte
+}
+
+func TestDecoderMaxMbUintBytes(t *testing.T) {
+	// opaque of length 3, encoded on 5 bytes
+	input := []byte{0x03, 0x01, 0x6A, 0x00, 0x6D, 0x4F,
+		0xC3, 0x80, 0x80, 0x80, 0x80, 0x03, 'a', 'b', 'c',
+		0x01, 0x01}
+
+	var msg opaqueMsg
+	err := NewDecoder(bytes.NewReader(input), syncMLTags, CodeSpace{}).Decode(&msg)
+	if err == nil {
+		t.Errorf("expected an error for a length longer than 4 bytes")
+	}
+
+	msg = opaqueMsg{}
+	d := NewDecoder(bytes.NewReader(input), syncMLTags, CodeSpace{})
+	d.MaxMbUintBytes = 5
+	err = d.Decode(&msg)
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	assert.Equal(t, opaqueMsg{Data: []byte("abc")}, msg)
+}
+
+func TestDecoderContentBit(t *testing.T) {
+	tests := []struct {
+		input    []byte
+		expected []Token
+	}{
+		{
+			// content bit set, but no content before END
+			input: []byte{0x03, 0x01, 0x6A, 0x00, 0x6D, 0x4F, 0x01, 0x01},
+			expected: []Token{
+				StartElement{Name: "SyncML", Content: true, Offset: 4, StartOffset: 4, EndOffset: 5},
+				StartElement{Name: "Data", Content: true, Offset: 5, StartOffset: 5, EndOffset: 6},
+				EndElement{Name: "Data", Offset: 7, StartOffset: 6, EndOffset: 7},
+				EndElement{Name: "SyncML", Offset: 8, StartOffset: 7, EndOffset: 8},
+			},
+		},
+		{
+			// content bit clear
+			input: []byte{0x03, 0x01, 0x6A, 0x00, 0x6D, 0x0F, 0x01},
+			expected: []Token{
+				StartElement{Name: "SyncML", Content: true, Offset: 4, StartOffset: 4, EndOffset: 5},
+				StartElement{Name: "Data", Content: false, Offset: 5, StartOffset: 5, EndOffset: 6},
+				EndElement{Name: "Data", Offset: 6, StartOffset: 6, EndOffset: 6},
+				EndElement{Name: "SyncML", Offset: 7, StartOffset: 6, EndOffset: 7},
+			},
+		},
+	}
+
+	for testID, test := range tests {
+		toks, err := NewDecoder(bytes.NewReader(test.input), syncMLTags, CodeSpace{}).DecodeAll()
+		if err != nil {
+			t.Errorf("case %d: unexpected error: %s", testID, err)
+			continue
+		}
+		assert.Equal(t, test.expected, toks, "case %d", testID)
+
+		// re-encoding the tokens gives back the same content bit
+		w := bytes.NewBuffer(nil)
+		e := NewEncoder(w, syncMLTags, CodeSpace{})
+		err = e.EncodeHeader(Header{Version: 3, PublicID: 1, Charset: 106})
+		if err != nil {
+			t.Errorf("case %d: unexpected error: %s", testID, err)
+			continue
+		}
+		for _, tok := range toks {
+			err := e.EncodeToken(tok)
+			if err != nil {
+				t.Errorf("case %d: unexpected error: %s", testID, err)
+			}
+		}
+		assert.Equal(t, test.input, w.Bytes(), "case %d", testID)
+
+		var msg opaqueMsg
+		err = NewDecoder(bytes.NewReader(test.input), syncMLTags, CodeSpace{}).Decode(&msg)
+		if err != nil {
+			t.Errorf("case %d: unexpected error: %s", testID, err)
+		}
+		assert.Equal(t, opaqueMsg{}, msg, "case %d", testID)
+	}
+}
+
+func TestDecoderFoldOpaque(t *testing.T) {
+	input := []byte{0x03, 0x01, 0x6A, 0x00, 0x6D,
+		0x4F, 0x03, 'a', 'b', 0x00, 0xC3, 0x02, 0x01, 0x02, 0x03, 'c', 'd', 0x00, 0x01,
+		0x4F, 0xC3, 0x02, 'x', 'y', 0x03, 'z', 0x00, 0x01,
+		0x4F, 0xC3, 0x01, 'w', 0x01,
+		0x01}
+
+	tests := []struct {
+		fold     bool
+		expected []Token
+	}{
+		{
+			fold: false,
+			expected: []Token{
+				StartElement{Name: "SyncML", Content: true, Offset: 4, StartOffset: 4, EndOffset: 5},
+				StartElement{Name: "Data", Content: true, Offset: 5, StartOffset: 5, EndOffset: 6},
+				CharData("ab"),
+				Opaque{0x01, 0x02},
+				CharData("cd"),
+				EndElement{Name: "Data", Offset: 19, StartOffset: 18, EndOffset: 19},
+				StartElement{Name: "Data", Content: true, Offset: 19, StartOffset: 19, EndOffset: 20},
+				Opaque("xy"),
+				CharData("z"),
+				EndElement{Name: "Data", Offset: 28, StartOffset: 27, EndOffset: 28},
+				StartElement{Name: "Data", Content: true, Offset: 28, StartOffset: 28, EndOffset: 29},
+				Opaque("w"),
+				EndElement{Name: "Data", Offset: 33, StartOffset: 32, EndOffset: 33},
+				EndElement{Name: "SyncML", Offset: 34, StartOffset: 33, EndOffset: 34},
+			},
+		},
+		{
+			fold: true,
+			expected: []Token{
+				StartElement{Name: "SyncML", Content: true, Offset: 4, StartOffset: 4, EndOffset: 5},
+				StartElement{Name: "Data", Content: true, Offset: 5, StartOffset: 5, EndOffset: 6},
+				CharData("ab\x01\x02cd"),
+				EndElement{Name: "Data", Offset: 19, StartOffset: 18, EndOffset: 19},
+				StartElement{Name: "Data", Content: true, Offset: 19, StartOffset: 19, EndOffset: 20},
+				CharData("xyz"),
+				EndElement{Name: "Data", Offset: 28, StartOffset: 27, EndOffset: 28},
+				StartElement{Name: "Data", Content: true, Offset: 28, StartOffset: 28, EndOffset: 29},
+				Opaque("w"),
+				EndElement{Name: "Data", Offset: 33, StartOffset: 32, EndOffset: 33},
+				EndElement{Name: "SyncML", Offset: 34, StartOffset: 33, EndOffset: 34},
+			},
+		},
+	}
+
+	for testID, test := range tests {
+		d := NewDecoder(bytes.NewReader(input), syncMLTags, CodeSpace{})
+		d.FoldOpaque = test.fold
+		toks, err := d.DecodeAll()
+		if err != nil {
+			t.Errorf("case %d: unexpected error: %s", testID, err)
+		}
+		assert.Equal(t, test.expected, toks, "case %d", testID)
+	}
+}
+
+type seenMsg struct {
+	SyncHdr  seenHeader
+	Elements map[string]bool `wbxml:",seen"`
+}
+
+type seenHeader struct {
+	VerDTD string
+	Names  []string `wbxml:",seen"`
+}
+
+func TestDecoderDecodeSeenField(t *testing.T) {
+	var msg seenMsg
+	err := NewDecoder(bytes.NewReader(syncMLInput), syncMLTags, CodeSpace{}).Decode(&msg)
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+
+	expected := seenMsg{
+		SyncHdr: seenHeader{
+			VerDTD: "1.2",
+			Names:  []string{"VerDTD", "VerProto", "SessionID", "MsgID", "Source", "Target", "Meta"},
+		},
+		Elements: map[string]bool{"SyncHdr": true, "SyncBody": true},
+	}
+	assert.Equal(t, expected, msg)
+}
+
+func TestDecoderGetStringMidString(t *testing.T) {
+	d := NewDecoder(nil, nil, nil)
+	d.Header = headerExamples[1]
+
+	tests := []struct {
+		index    uint32
+		expected string
+	}{
+		{0, "abc"},
+		{1, "bc"},
+		{4, " Enter name: "},
+		{5, "Enter name: "},
+		{11, "name: "},
+	}
+	for testID, test := range tests {
+		str, err := d.GetString(test.index)
+		if err != nil {
+			t.Errorf("case %d: unexpected error: %s", testID, err)
+			continue
+		}
+		assert.Equal(t, test.expected, string(str), "case %d", testID)
+	}
+
+	// a STR_T into the middle of " Enter name: "
+	input := []byte{0x01, 0x01, 0x6A, 0x12, 'a', 'b', 'c', 00, ' ', 'E', 'n', 't', 'e', 'r', ' ', 'n', 'a', 'm', 'e', ':', ' ', 00,
+		0x45, 0x83, 0x05, 0x01}
+	var card wmlTextCard
+	err := NewDecoder(bytes.NewReader(input), tagSpaceExamples[1].tags, tagSpaceExamples[1].attrs).Decode(&card)
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	assert.Equal(t, wmlTextCard{Text: "Enter name: "}, card)
+}
+
+type countMsg struct {
+	Data int
+}
+
+func TestDecoderNumberCleaner(t *testing.T) {
+	input := []byte{0x03, 0x01, 0x6A, 0x00, 0x6D, 0x4F, 0x03, '1', ',', '0', '0', '0', 0x00, 0x01, 0x01}
+
+	var msg countMsg
+	err := NewDecoder(bytes.NewReader(input), syncMLTags, CodeSpace{}).Decode(&msg)
+	if err == nil {
+		t.Errorf("expected an error for \"1,000\" without NumberCleaner")
+	}
+
+	msg = countMsg{}
+	d := NewDecoder(bytes.NewReader(input), syncMLTags, CodeSpace{})
+	d.NumberCleaner = func(s string) string {
+		return strings.Replace(s, ",", "", -1)
+	}
+	err = d.Decode(&msg)
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	assert.Equal(t, countMsg{Data: 1000}, msg)
+}
+
+type floatMsg struct {
+	Data float64
+}
+
+func TestDecoderDecodeFloat(t *testing.T) {
+	input := []byte{0x03, 0x01, 0x6A, 0x00, 0x6D, 0x4F, 0x03, '1', '2', '.', '5', 0x00, 0x01, 0x01}
+
+	var msg floatMsg
+	err := NewDecoder(bytes.NewReader(input), syncMLTags, CodeSpace{}).Decode(&msg)
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	assert.Equal(t, floatMsg{Data: 12.5}, msg)
+}
+
+func TestDecoderElementOffsets(t *testing.T) {
+	d := NewDecoder(bytes.NewReader(syncMLInput), syncMLTags, CodeSpace{})
+	var start StartElement
+	var end EndElement
+	for {
+		tok, err := d.Token()
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if st, ok := tok.(StartElement); ok && st.Name == "EMI" {
+			start = st
+		}
+		if e, ok := tok.(EndElement); ok && e.Name == "EMI" {
+			end = e
+			break
+		}
+	}
+
+	// 0x46 is EMI on page 1, followed by a SWITCH_PAGE to 8 for Sign
+	emi := bytes.Index(syncMLInput, []byte{0x46, 0x00, 0x08, 0x49})
+	sign := bytes.Index(syncMLInput, []byte{0xa9, 0x01, 0x01})
+	assert.Equal(t, emi, start.Offset)
+	assert.Equal(t, emi, start.StartOffset)
+	assert.Equal(t, emi+1, start.EndOffset)
+	assert.Equal(t, sign+3, end.Offset)
+	assert.Equal(t, sign+2, end.StartOffset)
+	assert.Equal(t, sign+3, end.EndOffset)
+	assert.Equal(t, byte(0x01), syncMLInput[end.StartOffset])
+
+	// the span of <DO TYPE="ACCEPT" URL="xyz.org/s"/> includes its attributes, while its
+	// end has no END token
+	space := tagSpaceExamples[1]
+	d = NewDecoder(bytes.NewReader(decodingExamples[1]), space.tags, space.attrs)
+	for {
+		tok, err := d.Token()
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if st, ok := tok.(StartElement); ok && st.Name == "DO" {
+			start = st
+		}
+		if e, ok := tok.(EndElement); ok && e.Name == "DO" {
+			end = e
+			break
+		}
+	}
+	do := bytes.IndexByte(decodingExamples[1], 0x88)
+	attrsEnd := bytes.Index(decodingExamples[1], []byte{'/', 's', 0x00, 0x01}) + 4
+	assert.Equal(t, do, start.StartOffset)
+	assert.Equal(t, attrsEnd, start.EndOffset)
+	assert.Equal(t, attrsEnd-1, start.Offset)
+	assert.Equal(t, EndElement{Name: "DO", Offset: attrsEnd, StartOffset: attrsEnd, EndOffset: attrsEnd}, end)
+}
+
+type wmlAttrsCard struct {
+	DO wmlAttrsDo
+}
+
+type wmlAttrsDo struct {
+	Attrs []Attr `wbxml:",attrs"`
+}
+
+func TestDecoderDecodeAttrsField(t *testing.T) {
+	space := tagSpaceExamples[1]
+	d := NewDecoder(bytes.NewReader(decodingExamples[1]), space.tags, space.attrs)
+
+	var deck struct {
+		CARD wmlAttrsCard
+	}
+	err := d.Decode(&deck)
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	expected := []Attr{
+		Attr{"TYPE", "ACCEPT"},
+		Attr{"URL", "xyz.org/s"},
+	}
+	assert.Equal(t, expected, deck.CARD.DO.Attrs)
+
+	var unexported struct {
+		CARD struct {
+			DO struct {
+				attrs []Attr `wbxml:",attrs"`
+			}
+		}
+	}
+	d = NewDecoder(bytes.NewReader(decodingExamples[1]), space.tags, space.attrs)
+	err = d.Decode(&unexported)
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	assert.Nil(t, unexported.CARD.DO.attrs)
+}
+
+type trimmedMsg struct {
+	Data string `wbxml:"Data,trim"`
+}
+
+func TestDecoderDecodeTrim(t *testing.T) {
+	input := []byte{0x03, 0x01, 0x6A, 0x00, 0x6D, 0x4F,
+		0x03, ' ', 'E', 'n', 't', 'e', 'r', ' ', 'n', 'a', 'm', 'e', ':', ' ', 0x00,
+		0x01, 0x01}
+
+	var msg textMsg
+	err := NewDecoder(bytes.NewReader(input), syncMLTags, CodeSpace{}).Decode(&msg)
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	assert.Equal(t, textMsg{Data: " Enter name: "}, msg)
+
+	var trimmed trimmedMsg
+	err = NewDecoder(bytes.NewReader(input), syncMLTags, CodeSpace{}).Decode(&trimmed)
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	assert.Equal(t, trimmedMsg{Data: "Enter name:"}, trimmed)
+}
+
+func TestDecoderDecodeEmptyString(t *testing.T) {
+	// SessionID without content, then with a content bit but no content
+	inputs := [][]byte{
+		{0x03, 0x01, 0x6A, 0x00, 0x6D, 0x6C, 0x25, 0x01, 0x01},
+		{0x03, 0x01, 0x6A, 0x00, 0x6D, 0x6C, 0x65, 0x01, 0x01, 0x01},
+	}
+
+	for testID, input := range inputs {
+		msg := struct {
+			SyncHdr fullheader
+		}{
+			SyncHdr: fullheader{SessionID: "previous"},
+		}
+		err := NewDecoder(bytes.NewReader(input), syncMLTags, CodeSpace{}).Decode(&msg)
+		if err != nil {
+			t.Errorf("case %d: unexpected error: %s", testID, err)
+		}
+		assert.Equal(t, "", msg.SyncHdr.SessionID, "case %d", testID)
+	}
+}
+
+func TestDecoderDecodeEmptyNumbers(t *testing.T) {
+	// Data without content, then with a content bit but no content
+	inputs := [][]byte{
+		{0x03, 0x01, 0x6A, 0x00, 0x6D, 0x0F, 0x01},
+		{0x03, 0x01, 0x6A, 0x00, 0x6D, 0x4F, 0x01, 0x01},
+	}
+
+	for testID, input := range inputs {
+		str := textMsg{Data: "previous"}
+		err := NewDecoder(bytes.NewReader(input), syncMLTags, CodeSpace{}).Decode(&str)
+		if err != nil {
+			t.Errorf("case %d: string: unexpected error: %s", testID, err)
+		}
+		assert.Equal(t, textMsg{}, str, "case %d", testID)
+
+		i := countMsg{Data: 12}
+		err = NewDecoder(bytes.NewReader(input), syncMLTags, CodeSpace{}).Decode(&i)
+		if err != nil {
+			t.Errorf("case %d: int: unexpected error: %s", testID, err)
+		}
+		assert.Equal(t, countMsg{}, i, "case %d", testID)
+
+		u := struct{ Data uint32 }{Data: 12}
+		err = NewDecoder(bytes.NewReader(input), syncMLTags, CodeSpace{}).Decode(&u)
+		if err != nil {
+			t.Errorf("case %d: uint: unexpected error: %s", testID, err)
+		}
+		assert.Equal(t, uint32(0), u.Data, "case %d", testID)
+
+		f := floatMsg{Data: 1.5}
+		err = NewDecoder(bytes.NewReader(input), syncMLTags, CodeSpace{}).Decode(&f)
+		if err != nil {
+			t.Errorf("case %d: float: unexpected error: %s", testID, err)
+		}
+		assert.Equal(t, floatMsg{}, f, "case %d", testID)
+	}
+}
+
+// literalTagsInput is a document whose tags and attributes are all LITERAL.
+var literalTagsInput = []byte{0x03, 0x01, 0x6A, 0x0C, 'S', 'y', 'n', 'c', 'M', 'L', 0x00, 'D', 'a', 't', 'a', 0x00,
+	0x44, 0x00,
+	0x44, 0x07, 0x03, 'x', 0x00, 0x01,
+	0x84, 0x07, 0x04, 0x00, 0x03, 'v', 0x00, 0x01,
+	0x01}
+
+func TestDecoderLiteralTags(t *testing.T) {
+	toks, err := NewDecoder(bytes.NewReader(literalTagsInput), CodeSpace{}, CodeSpace{}).DecodeAll()
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	expected := []Token{
+		StartElement{Name: "SyncML", Content: true, Offset: 17, StartOffset: 16, EndOffset: 18},
+		StartElement{Name: "Data", Content: true, Offset: 19, StartOffset: 18, EndOffset: 20},
+		CharData("x"),
+		EndElement{Name: "Data", Offset: 24, StartOffset: 23, EndOffset: 24},
+		StartElement{Name: "Data", Attr: []Attr{{Name: "SyncML", Value: "v"}}, Offset: 31, StartOffset: 24, EndOffset: 32},
+		EndElement{Name: "Data", Offset: 32, StartOffset: 32, EndOffset: 32},
+		EndElement{Name: "SyncML", Offset: 33, StartOffset: 32, EndOffset: 33},
+	}
+	assert.Equal(t, expected, toks)
+}
+
+func TestDecoderPeek(t *testing.T) {
+	d := NewDecoder(bytes.NewReader(syncMLInput), syncMLTags, CodeSpace{})
+
+	peeked, err := d.Peek()
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	again, err := d.Peek()
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	tok, err := d.Token()
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	assert.Equal(t, peeked, again)
+	assert.Equal(t, peeked, tok)
+	assert.Equal(t, "SyncML", tok.(StartElement).Name)
+
+	tok, err = d.Token()
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	assert.Equal(t, "SyncHdr", tok.(StartElement).Name)
+
+	// the whole document is still decoded after peeking at each token
+	count := 2
+	for {
+		_, err := d.Peek()
+		if err != nil {
+			assert.Equal(t, io.EOF, err)
+			break
+		}
+		_, err = d.Token()
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		count++
+	}
+	_, err = d.Token()
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, 0, d.depth)
+	toks, err := NewDecoder(bytes.NewReader(syncMLInput), syncMLTags, CodeSpace{}).DecodeAll()
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	assert.Equal(t, len(toks), count)
+}
+
+// readStatuses decodes the Status elements following in d, and gives back the first
+// token that is not one.
+func readStatuses(d *Decoder) ([]status, error) {
+	var list []status
+	for {
+		tok, err := d.Token()
+		if err != nil {
+			return list, err
+		}
+		if st, ok := tok.(StartElement); ok && st.Name == "Status" {
+			var s status
+			err := d.DecodeElement(&s, &st)
+			if err != nil {
+				return list, err
+			}
+			list = append(list, s)
+			continue
+		}
+		return list, d.UnreadToken(tok)
+	}
+}
+
+func TestDecoderUnreadToken(t *testing.T) {
+	d := NewDecoder(bytes.NewReader(syncMLInput), syncMLTags, CodeSpace{})
+	for {
+		tok, err := d.Token()
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if st, ok := tok.(StartElement); ok && st.Name == "SyncBody" {
+			break
+		}
+	}
+
+	list, err := readStatuses(d)
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	assert.Equal(t, []status{{CmdID: 1, MsgRef: 93, CmdRef: 1, Cmd: "Put", Data: 500}}, list)
+	assert.Error(t, d.UnreadToken(StartElement{Name: "Final"}))
+
+	tok, err := d.Token()
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	assert.Equal(t, "Final", tok.(StartElement).Name)
+	assert.Equal(t, 3, d.depth)
+
+	toks, err := d.DecodeAll()
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	assert.Equal(t, 3, len(toks))
+	assert.Equal(t, 0, d.depth)
+}
+
+func TestDecoderUnreadOtherToken(t *testing.T) {
+	d := NewDecoder(bytes.NewReader(syncMLInput), syncMLTags, CodeSpace{})
+	err := d.UnreadToken(StartElement{Name: "SyncML"})
+	assert.Equal(t, "StartElement SyncML is not the last token returned by Token", err.Error())
+
+	tok, err := d.Token()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	err = d.UnreadToken(EndElement{Name: "SyncML"})
+	assert.Equal(t, "EndElement SyncML is not the last token returned by Token", err.Error())
+	assert.Equal(t, 1, d.depth)
+
+	if err := d.UnreadToken(tok); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	assert.Equal(t, 0, d.depth)
+	again, err := d.Token()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	assert.Equal(t, tok, again)
+	assert.Equal(t, 1, d.depth)
+}
+
+func TestDecoderDecodeOpaqueInteger(t *testing.T) {
+	input := []byte{0x03, 0x01, 0x6A, 0x00, 0x6D,
+		0x4F, 0xC3, 0x04, 0x00, 0x01, 0x02, 0x03, 0x01,
+		0x5A, 0xC3, 0x02, 0xFF, 0xFE, 0x01,
+		0x01}
+
+	var msg struct {
+		Data uint32 `wbxml:",opaque"`
+		Meta uint16 `wbxml:",opaque"`
+	}
+	err := NewDecoder(bytes.NewReader(input), syncMLTags, CodeSpace{}).Decode(&msg)
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	assert.Equal(t, uint32(0x010203), msg.Data)
+	assert.Equal(t, uint16(0xFFFE), msg.Meta)
+
+	var signed struct {
+		Data int32 `wbxml:",opaque"`
+		Meta int16 `wbxml:",opaque"`
+	}
+	err = NewDecoder(bytes.NewReader(input), syncMLTags, CodeSpace{}).Decode(&signed)
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	assert.Equal(t, int32(0x010203), signed.Data)
+	assert.Equal(t, int16(-2), signed.Meta)
+
+	var untagged struct {
+		Data uint32
+	}
+	err = NewDecoder(bytes.NewReader(input), syncMLTags, CodeSpace{}).Decode(&untagged)
+	if err == nil {
+		t.Errorf("expected an error for an opaque without ,opaque")
+	}
+
+	var small struct {
+		Data uint16 `wbxml:",opaque"`
+	}
+	err = NewDecoder(bytes.NewReader(input), syncMLTags, CodeSpace{}).Decode(&small)
+	if err == nil {
+		t.Errorf("expected an error for an opaque larger than the field")
+	}
+}
+
+func TestDecoderEmptyStringTable(t *testing.T) {
+	space := tagSpaceExamples[0]
+	d := NewDecoder(bytes.NewReader(decodingExamples[0]), space.tags, space.attrs)
+	toks, err := d.DecodeAll()
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	assert.Equal(t, 0, len(d.Header.StringTable))
+	assert.Equal(t, 8, len(toks))
+
+	input := []byte{0x03, 0x01, 0x6A, 0x00, 0x6D, 0x4F, 0x83, 0x00, 0x01, 0x01}
+	var msg textMsg
+	err = NewDecoder(bytes.NewReader(input), syncMLTags, CodeSpace{}).Decode(&msg)
+	if err == nil {
+		t.Fatalf("expected an error for a reference to an empty string table")
+	}
+	assert.True(t, strings.Contains(err.Error(), "no string table"), err.Error())
+}
+
+func TestDecoderRootSwitchPage(t *testing.T) {
+	input := []byte{0x03, 0x01, 0x6A, 0x00, 0x00, 0x08, 0x45, 0x00, 0x00, 0x05, 0x01}
+
+	for _, emit := range []bool{false, true} {
+		d := NewDecoder(bytes.NewReader(input), syncMLTags, CodeSpace{})
+		d.EmitSwitchPage = emit
+		toks, err := d.DecodeAll()
+		if err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		expected := []Token{
+			SwitchPage(8),
+			StartElement{Name: "CS", Content: true, Offset: 6, StartOffset: 6, EndOffset: 7},
+			SwitchPage(0),
+			StartElement{Name: "Add", Offset: 9, StartOffset: 9, EndOffset: 10},
+			EndElement{Name: "Add", Offset: 10, StartOffset: 10, EndOffset: 10},
+			EndElement{Name: "CS", Offset: 11, StartOffset: 10, EndOffset: 11},
+		}
+		if !emit {
+			expected = []Token{expected[1], expected[3], expected[4], expected[5]}
+		}
+		assert.Equal(t, expected, toks, "EmitSwitchPage %v", emit)
+	}
+}
+
+type namedCmd struct {
+	Name  string `wbxml:",name"`
+	CmdID uint32
+}
+
+func TestDecoderDecodeNameField(t *testing.T) {
+	var msg struct {
+		SyncBody struct {
+			Status namedCmd
+			Final  namedCmd
+		}
+	}
+	err := NewDecoder(bytes.NewReader(syncMLInput), syncMLTags, CodeSpace{}).Decode(&msg)
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	assert.Equal(t, namedCmd{Name: "Status", CmdID: 1}, msg.SyncBody.Status)
+	assert.Equal(t, namedCmd{Name: "Final"}, msg.SyncBody.Final)
+}
+
+func TestDecoderLiteralChild(t *testing.T) {
+	input := []byte{0x03, 0x01, 0x6A, 0x07, 'C', 'u', 's', 't', 'o', 'm', 0x00,
+		0x6D,
+		0x4F, 0x03, '1', 0x00, 0x01,
+		0x44, 0x00, 0x03, 'v', 0x00, 0x01,
+		0x01}
+
+	toks, err := NewDecoder(bytes.NewReader(input), syncMLTags, CodeSpace{}).DecodeAll()
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	expected := []Token{
+		StartElement{Name: "SyncML", Content: true, Offset: 11, StartOffset: 11, EndOffset: 12},
+		StartElement{Name: "Data", Content: true, Offset: 12, StartOffset: 12, EndOffset: 13},
+		CharData("1"),
+		EndElement{Name: "Data", Offset: 17, StartOffset: 16, EndOffset: 17},
+		StartElement{Name: "Custom", Content: true, Offset: 18, StartOffset: 17, EndOffset: 19},
+		CharData("v"),
+		EndElement{Name: "Custom", Offset: 23, StartOffset: 22, EndOffset: 23},
+		EndElement{Name: "SyncML", Offset: 24, StartOffset: 23, EndOffset: 24},
+	}
+	assert.Equal(t, expected, toks)
+
+	var msg struct {
+		Data   string
+		Custom string
+	}
+	err = NewDecoder(bytes.NewReader(input), syncMLTags, CodeSpace{}).Decode(&msg)
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	assert.Equal(t, "1", msg.Data)
+	assert.Equal(t, "v", msg.Custom)
+}
+
+func TestDecoderWarnings(t *testing.T) {
+	space := tagSpaceExamples[1]
+	// CARD with NAME="a" followed by the entity U+00E9
+	input := []byte{0x01, 0x01, 0x6A, 0x00, 0x85, 0x09, 0x03, 'a', 0x00, 0x02, 0x81, 0x69, 0x01}
+
+	d := NewDecoder(bytes.NewReader(input), space.tags, space.attrs)
+	toks, err := d.DecodeAll()
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	assert.Equal(t, []Attr{{"NAME", "aé"}}, toks[0].(StartElement).Attr)
+	assert.Equal(t, []Warning{{Msg: "entity 0xE9 flattened into an attribute value", Offset: 12}}, d.Warnings)
+
+	// non minimal multi-byte integer, in lenient mode
+	input = []byte{0x01, 0x01, 0x6A, 0x80, 0x00, 0x05}
+	d = NewDecoder(bytes.NewReader(input), space.tags, space.attrs)
+	_, err = d.DecodeAll()
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	assert.Equal(t, []Warning{{Msg: "multi-byte integer is not in its minimal form", Offset: 4}}, d.Warnings)
+}
+
+func TestDecoderBase64Opaque(t *testing.T) {
+	space := tagSpaceExamples[0]
+	// XYZ with an opaque "AQL/" in CARD, and in BR
+	input := []byte{0x01, 0x01, 0x6A, 0x00, 0x47, 0x46, 0xC3, 0x04, 'A', 'Q', 'L', '/', 0x01,
+		0x45, 0xC3, 0x04, 'A', 'Q', 'L', '/', 0x01, 0x01}
+
+	d := NewDecoder(bytes.NewReader(input), space.tags, space.attrs)
+	d.RegisterOpaque("CARD", Base64Opaque)
+	toks, err := d.DecodeAll()
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	assert.Equal(t, Opaque{0x01, 0x02, 0xFF}, toks[2])
+	assert.Equal(t, Opaque("AQL/"), toks[5])
+
+	input[8] = '!'
+	d = NewDecoder(bytes.NewReader(input), space.tags, space.attrs)
+	d.RegisterOpaque("CARD", Base64Opaque)
+	_, err = d.DecodeAll()
+	assert.NotNil(t, err)
+}
+
+type hexMsg struct {
+	Data []byte `wbxml:"Data,hex"`
+}
+
+type base64Msg struct {
+	Data []byte `wbxml:"Data,base64"`
+}
+
+func TestDecoderDecodeBinaryText(t *testing.T) {
+	text := func(s string) []byte {
+		input := []byte{0x03, 0x01, 0x6A, 0x00, 0x6D, 0x4F, 0x03}
+		return append(append(input, s...), 0x00, 0x01, 0x01)
+	}
+
+	var hexed hexMsg
+	err := NewDecoder(bytes.NewReader(text("0102ff")), syncMLTags, CodeSpace{}).Decode(&hexed)
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	assert.Equal(t, hexMsg{Data: []byte{0x01, 0x02, 0xFF}}, hexed)
+
+	var based base64Msg
+	err = NewDecoder(bytes.NewReader(text(" AQL/ ")), syncMLTags, CodeSpace{}).Decode(&based)
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	assert.Equal(t, base64Msg{Data: []byte{0x01, 0x02, 0xFF}}, based)
+
+	err = NewDecoder(bytes.NewReader(text("0x01")), syncMLTags, CodeSpace{}).Decode(&hexMsg{})
+	assert.NotNil(t, err)
+	err = NewDecoder(bytes.NewReader(text("AQ!/")), syncMLTags, CodeSpace{}).Decode(&base64Msg{})
+	assert.NotNil(t, err)
+}
+
+// repeatReader returns its byte forever.
+type repeatReader byte
+
+func (r repeatReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = byte(r)
+	}
+	return len(p), nil
+}
+
+func TestDecoderUnterminatedAttrValue(t *testing.T) {
+	space := tagSpaceExamples[1]
+	inputs := []io.Reader{
+		bytes.NewReader([]byte{0x01, 0x01, 0x6A, 0x00, 0xC5, 0x09, 0x03, 'a', 0x00}),
+		io.MultiReader(bytes.NewReader([]byte{0x01, 0x01, 0x6A, 0x00, 0xC5, 0x09}), repeatReader(0x85)),
+	}
+	messages := []string{
+		"unterminated attribute value",
+		fmt.Sprintf("attribute value of more than %d tokens", maxAttrValueTokens),
+	}
+	for testID, input := range inputs {
+		_, err := NewDecoder(input, space.tags, space.attrs).DecodeAll()
+		serr, ok := err.(*SyntaxError)
+		if !ok {
+			t.Fatalf("case %d: expected a SyntaxError, got %v", testID, err)
+		}
+		assert.Equal(t, messages[testID], serr.Msg, "case %d", testID)
+	}
+}
+
+func TestNewBytesDecoder(t *testing.T) {
+	for testID, input := range decodingExamples {
+		space := tagSpaceExamples[testID]
+		expected, err := NewDecoder(bytes.NewReader(input), space.tags, space.attrs).DecodeAll()
+		if err != nil {
+			t.Errorf("case %d: unexpected error: %s", testID, err)
+		}
+		toks, err := NewBytesDecoder(input, space.tags, space.attrs).DecodeAll()
+		if err != nil {
+			t.Errorf("case %d: unexpected error: %s", testID, err)
+		}
+		assert.Equal(t, expected, toks, "case %d", testID)
+	}
+
+	// the tokens alias the input
+	input := []byte{0x03, 0x01, 0x6A, 0x00, 0x6D, 0x4F, 0xC3, 0x03, 0x01, 0x02, 0x03, 0x01,
+		0x4F, 0x03, 'a', 'b', 0x00, 0x03, 'c', 0x00, 0x01, 0x01}
+	toks, err := NewBytesDecoder(input, syncMLTags, CodeSpace{}).DecodeAll()
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	assert.Equal(t, Opaque{0x01, 0x02, 0x03}, toks[2])
+	assert.Equal(t, CharData("abc"), toks[5])
+	input[8] = 0xFF
+	assert.Equal(t, Opaque{0xFF, 0x02, 0x03}, toks[2])
+	// the following string was appended to a copy
+	assert.Equal(t, []byte{'a', 'b', 0x00, 0x03, 'c', 0x00}, input[14:20])
+
+	// truncated opaque
+	_, err = NewBytesDecoder(input[:9], syncMLTags, CodeSpace{}).DecodeAll()
+	assert.NotNil(t, err)
+}
+
+func BenchmarkDecoder(b *testing.B) {
+	// SyncML with 100 Data of 64 bytes of opaque
+	data := append(append([]byte{0x4F, 0xC3, 0x40}, make([]byte, 0x40)...), 0x01)
+	input := append([]byte{0x03, 0x01, 0x6A, 0x00, 0x6D}, bytes.Repeat(data, 100)...)
+	input = append(input, 0x01)
+	b.Run("copy", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			_, err := NewDecoder(bytes.NewReader(input), syncMLTags, CodeSpace{}).DecodeAll()
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("alias", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			_, err := NewBytesDecoder(input, syncMLTags, CodeSpace{}).DecodeAll()
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+type sourceRef struct {
+	LocURI string
+}
+
+type targetRef struct {
+	LocURI  string
+	LocName string
+}
+
+func TestDecoderSameFieldNameInParents(t *testing.T) {
+	toks := []Token{
+		StartElement{Name: "SyncML", Content: true},
+		StartElement{Name: "Target", Content: true},
+		StartElement{Name: "LocURI", Content: true},
+		CharData("target"),
+		EndElement{Name: "LocURI"},
+		EndElement{Name: "Target"},
+		StartElement{Name: "Source", Content: true},
+		StartElement{Name: "LocURI", Content: true},
+		CharData("source"),
+		EndElement{Name: "LocURI"},
+		EndElement{Name: "Source"},
+		EndElement{Name: "SyncML"},
+	}
+	var msg struct {
+		Source sourceRef
+		Target targetRef
+	}
+	err := NewTokenDecoder(toks).Decode(&msg)
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	assert.Equal(t, sourceRef{LocURI: "source"}, msg.Source)
+	assert.Equal(t, targetRef{LocURI: "target"}, msg.Target)
+}
+
+func TestDecoderDecodeNotStartElement(t *testing.T) {
+	toks := []Token{CharData("abc"), StartElement{Name: "SyncML"}, EndElement{Name: "SyncML"}}
+	var msg struct{}
+	err := NewTokenDecoder(toks).Decode(&msg)
+	assert.Equal(t, fmt.Errorf(`expected a StartElement, got CharData "abc"`), err)
+}
+
+func TestDecoderExpectedCharDataErrors(t *testing.T) {
+	tests := []struct {
+		v        interface{}
+		tok      Token
+		expected string
+	}{
+		{new(string), StartElement{Name: "Data"}, "string expected a CharData, got StartElement Data"},
+		{new(string), Entity(0xE9), "string expected a CharData, got Entity 0xE9"},
+		{new([]byte), Entity(0x41), "[]byte expected a CharData, got Entity 0x41"},
+	}
+	for testID, test := range tests {
+		toks := []Token{StartElement{Name: "Msg", Content: true}, test.tok, EndElement{Name: "Msg"}}
+		err := NewTokenDecoder(toks).Decode(test.v)
+		assert.Equal(t, errors.New(test.expected), err, "case %d", testID)
+	}
+}
+
+type headers map[string]string
+
+func TestDecoderDecodeNamedMap(t *testing.T) {
+	toks := []Token{
+		StartElement{Name: "Msg", Content: true},
+		StartElement{Name: "Meta", Content: true},
+		StartElement{Name: "Type", Content: true},
+		CharData("text/plain"),
+		EndElement{Name: "Type"},
+		StartElement{Name: "Format", Content: true},
+		CharData("chr"),
+		EndElement{Name: "Format"},
+		EndElement{Name: "Meta"},
+		EndElement{Name: "Msg"},
+	}
+	var msg struct {
+		Meta headers
+	}
+	err := NewTokenDecoder(toks).Decode(&msg)
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	assert.Equal(t, headers{"Type": "text/plain", "Format": "chr"}, msg.Meta)
+
+	var plain struct {
+		Meta map[string]string
+	}
+	err = NewTokenDecoder(toks).Decode(&plain)
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	assert.Equal(t, map[string]string{"Type": "text/plain", "Format": "chr"}, plain.Meta)
+
+	var wrongKey struct {
+		Meta map[int]string
+	}
+	err = NewTokenDecoder(toks).Decode(&wrongKey)
+	assert.NotNil(t, err)
+}
+
+var pushTags = CodeSpace{0: CodePage{0x05: "Push", 0x06: "Body", 0x07: "From"}}
+
+var provTags = CodeSpace{0: CodePage{0x05: "Prov", 0x06: "Param"}}
+
+type provDoc struct {
+	Prov struct {
+		Param string
+	}
+}
+
+// provBody decodes the content of a Body with the provTags profile.
+type provBody struct {
+	Doc provDoc
+}
+
+func (b *provBody) UnmarshalWBXML(d *Decoder, start *StartElement) error {
+	return d.DecodeElementWith(&b.Doc, start, provTags, nil)
+}
+
+func TestDecoderDecodeElementWith(t *testing.T) {
+	// Push with a Body holding a Prov document, then a From after it
+	input := []byte{0x03, 0x01, 0x6A, 0x00, 0x45,
+		0x46, 0x45, 0x46, 0x03, 'x', 0x00, 0x01, 0x01, 0x01,
+		0x47, 0x03, 'y', 0x00, 0x01,
+		0x01}
+	var push struct {
+		Body provBody
+		From string
+	}
+	err := NewDecoder(bytes.NewReader(input), pushTags, nil).Decode(&push)
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	assert.Equal(t, "x", push.Body.Doc.Prov.Param)
+	assert.Equal(t, "y", push.From)
+}
+
+func TestDecoderDecodeIntSources(t *testing.T) {
+	decode := func(v interface{}, tok Token) error {
+		toks := []Token{StartElement{Name: "Msg", Content: true},
+			StartElement{Name: "Data", Content: true}, tok, EndElement{Name: "Data"},
+			EndElement{Name: "Msg"}}
+		return NewTokenDecoder(toks).Decode(v)
+	}
+
+	var msg countMsg
+	err := decode(&msg, CharData("-42"))
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	assert.Equal(t, -42, msg.Data)
+
+	err = decode(&msg, Entity(0xFFFFFFFF))
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	assert.Equal(t, 0xFFFFFFFF, msg.Data)
+
+	var small struct {
+		Data int8
+	}
+	err = decode(&small, Entity(0x7F))
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	assert.Equal(t, int8(0x7F), small.Data)
+	err = decode(&small, Entity(0x80))
+	assert.Equal(t, fmt.Errorf("field Data: entity 128 overflows int8"), err)
+
+	var unsigned struct {
+		Data uint16
+	}
+	err = decode(&unsigned, Entity(0x10000))
+	assert.Equal(t, fmt.Errorf("field Data: entity 65536 overflows uint16"), err)
+}
+
+// literalAttrsInput is a CARD whose attributes mix codes of the attribute code space and
+// LITERAL names of the string table.
+var literalAttrsInput = []byte{0x01, 0x01, 0x6A, 0x09, 'l', 'a', 'n', 'g', 0x00, 'd', 'i', 'r', 0x00,
+	0x85,
+	0x09, 0x03, 'a', 0x00,
+	0x04, 0x00, 0x03, 'f', 'r', 0x00,
+	0x04, 0x05, 0x03, 'r', 't', 'l', 0x00,
+	0x06, 0x03, 'x', 0x00,
+	0x01}
+
+func TestDecoderLiteralAttrs(t *testing.T) {
+	space := tagSpaceExamples[1]
+	toks, err := NewDecoder(bytes.NewReader(literalAttrsInput), space.tags, space.attrs).DecodeAll()
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	expected := []Attr{{"NAME", "a"}, {"lang", "fr"}, {"dir", "rtl"}, {"TYPE", "x"}}
+	assert.Equal(t, expected, toks[0].(StartElement).Attr)
+}
+
+type langsMsg struct {
+	Data []string `wbxml:"Data,split= "`
+}
+
+func TestDecoderDecodeSplit(t *testing.T) {
+	input := []byte{0x03, 0x01, 0x6A, 0x00, 0x6D, 0x4F, 0x03, 'e', 'n', ' ', 'f', 'r', ' ', ' ', 'd', 'e', 0x00, 0x01, 0x01}
+	var msg langsMsg
+	err := NewDecoder(bytes.NewReader(input), syncMLTags, CodeSpace{}).Decode(&msg)
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	assert.Equal(t, langsMsg{Data: []string{"en", "fr", "de"}}, msg)
+
+	// without content
+	input = []byte{0x03, 0x01, 0x6A, 0x00, 0x6D, 0x0F, 0x01}
+	msg = langsMsg{}
+	err = NewDecoder(bytes.NewReader(input), syncMLTags, CodeSpace{}).Decode(&msg)
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	assert.Equal(t, langsMsg{}, msg)
+}
+
+func TestDecoderExtensionString(t *testing.T) {
+	// Data with a text, an EXT_I_0 and another text
+	input := []byte{0x03, 0x01, 0x6A, 0x00, 0x4F, 0x03, 'a', 0x00, 0x40, 'v', 'a', 'r', 0x00, 0x03, 'b', 0x00, 0x01}
+	toks, err := NewDecoder(bytes.NewReader(input), syncMLTags, CodeSpace{}).DecodeAll()
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	expected := []Token{
+		StartElement{Name: "Data", Content: true, Offset: 4, StartOffset: 4, EndOffset: 5},
+		CharData("a"),
+		Extension{ID: 0, Kind: ExtString, Data: []byte("var")},
+		CharData("b"),
+		EndElement{Name: "Data", Offset: 17, StartOffset: 16, EndOffset: 17},
+	}
+	assert.Equal(t, expected, toks)
+
+	w := bytes.NewBuffer(nil)
+	err = XML(w, NewDecoder(bytes.NewReader(input), syncMLTags, CodeSpace{}), "")
+	if err != nil && err != io.EOF {
+		t.Errorf("unexpected error: %s", err)
+	}
+	assert.Equal(t, `<Data>a<!-- EXT_I_0 "var" -->b</Data>`, w.String())
+}
+
+func TestDecoderExtensionStringAttr(t *testing.T) {
+	space := tagSpaceExamples[1]
+	// CARD with NAME "a" EXT_I_0 "var"
+	input := []byte{0x01, 0x01, 0x6A, 0x00, 0x85, 0x09, 0x03, 'a', 0x00, 0x40, 'v', 'a', 'r', 0x00, 0x01}
+	d := NewDecoder(bytes.NewReader(input), space.tags, space.attrs)
+	toks, err := d.DecodeAll()
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	assert.Equal(t, []Attr{{"NAME", "avar"}}, toks[0].(StartElement).Attr)
+	assert.Equal(t, []Warning{{Msg: "EXT_I_0 extension flattened into an attribute value", Offset: 14}}, d.Warnings)
+
+	// a single-byte extension has no text to flatten
+	input = []byte{0x01, 0x01, 0x6A, 0x00, 0x85, 0x09, 0xC0, 0x01}
+	_, err = NewDecoder(bytes.NewReader(input), space.tags, space.attrs).DecodeAll()
+	serr, ok := err.(*SyntaxError)
+	if !ok {
+		t.Fatalf("expected a SyntaxError, got %v", err)
+	}
+	assert.Equal(t, "EXT_0 extension in an attribute value", serr.Msg)
+}
+
+func TestDecoderExtensionInteger(t *testing.T) {
+	space := tagSpaceExamples[1]
+	// CARD with NAME "a" EXT_T_0 0 in attribute, and EXT_T_1 4 in content
+	input := []byte{0x01, 0x01, 0x6A, 0x08, 'x', 'y', 'z', 0x00, 'v', 'a', 'r', 0x00,
+		0xC5, 0x09, 0x03, 'a', 0x00, 0x80, 0x00, 0x01,
+		0x81, 0x04, 0x01}
+	d := NewDecoder(bytes.NewReader(input), space.tags, space.attrs)
+	toks, err := d.DecodeAll()
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	assert.Equal(t, []Attr{{"NAME", "axyz"}}, toks[0].(StartElement).Attr)
+	ext := Extension{ID: 1, Kind: ExtInteger, Index: 4}
+	assert.Equal(t, ext, toks[1])
+	assert.Equal(t, []Warning{{Msg: "EXT_T_0 extension flattened into an attribute value", Offset: 19}}, d.Warnings)
+
+	str, err := d.ExtensionString(ext)
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	assert.Equal(t, []byte("var"), str)
+	_, err = d.ExtensionString(Extension{ID: 0, Kind: ExtString, Data: []byte("var")})
+	assert.NotNil(t, err)
+
+	// the reference of an attribute value must be in the string table
+	input[18] = 0x0C
+	_, err = NewDecoder(bytes.NewReader(input), space.tags, space.attrs).DecodeAll()
+	assert.NotNil(t, err)
+}
+
+type optionalStatus struct {
+	Status *status
+	Final  bool
+}
+
+func TestDecoderDecodeOptionalPointer(t *testing.T) {
+	tests := []struct {
+		toks     []Token
+		expected *status
+	}{
+		{
+			[]Token{
+				StartElement{Name: "SyncBody", Content: true},
+				StartElement{Name: "Status", Content: true},
+				StartElement{Name: "CmdID", Content: true}, CharData("1"), EndElement{Name: "CmdID"},
+				EndElement{Name: "Status"},
+				StartElement{Name: "Final"}, EndElement{Name: "Final"},
+				EndElement{Name: "SyncBody"},
+			},
+			&status{CmdID: 1},
+		},
+		{
+			[]Token{
+				StartElement{Name: "SyncBody", Content: true},
+				StartElement{Name: "Status"}, EndElement{Name: "Status"},
+				StartElement{Name: "Final"}, EndElement{Name: "Final"},
+				EndElement{Name: "SyncBody"},
+			},
+			&status{},
+		},
+		{
+			[]Token{
+				StartElement{Name: "SyncBody", Content: true},
+				StartElement{Name: "Final"}, EndElement{Name: "Final"},
+				EndElement{Name: "SyncBody"},
+			},
+			nil,
+		},
+	}
+	for testID, test := range tests {
+		var body optionalStatus
+		err := NewTokenDecoder(test.toks).Decode(&body)
+		if err != nil {
+			t.Errorf("case %d: unexpected error: %s", testID, err)
+		}
+		assert.Equal(t, test.expected, body.Status, "case %d", testID)
+		assert.Equal(t, true, body.Final, "case %d", testID)
+	}
+}
+
+func TestDecoderExtensionByte(t *testing.T) {
+	// Data with texts around an EXT_0, then an EXT_2 directly followed by END
+	input := []byte{0x03, 0x01, 0x6A, 0x00, 0x4F, 0x03, 'a', 0x00, 0x03, 'b', 0x00, 0xC0,
+		0x03, 'c', 0x00, 0x03, 'd', 0x00, 0xC2, 0x01}
+	toks, err := NewDecoder(bytes.NewReader(input), syncMLTags, CodeSpace{}).DecodeAll()
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	expected := []Token{
+		StartElement{Name: "Data", Content: true, Offset: 4, StartOffset: 4, EndOffset: 5},
+		CharData("ab"),
+		Extension{ID: 0, Kind: ExtByte},
+		CharData("cd"),
+		Extension{ID: 2, Kind: ExtByte},
+		EndElement{Name: "Data", Offset: 20, StartOffset: 19, EndOffset: 20},
+	}
+	assert.Equal(t, expected, toks)
+}
+
+type jsonStatus struct {
+	ID      uint32 `json:"CmdID"`
+	Command string `json:"Cmd,omitempty"`
+	Data    uint32 `json:"-"`
+	Ref     int    `json:"CmdRef" wbxml:"Ref"`
+}
+
+func TestDecoderJSONTags(t *testing.T) {
+	toks := []Token{
+		StartElement{Name: "Status", Content: true},
+		StartElement{Name: "CmdID", Content: true}, CharData("1"), EndElement{Name: "CmdID"},
+		StartElement{Name: "Cmd", Content: true}, CharData("Put"), EndElement{Name: "Cmd"},
+		StartElement{Name: "CmdRef", Content: true}, CharData("2"), EndElement{Name: "CmdRef"},
+		StartElement{Name: "Data", Content: true}, CharData("100"), EndElement{Name: "Data"},
+		EndElement{Name: "Status"},
+	}
+	var st jsonStatus
+	d := NewTokenDecoder(toks)
+	d.JSONTags = true
+	err := d.Decode(&st)
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	assert.Equal(t, jsonStatus{ID: 1, Command: "Put", Data: 100}, st)
+
+	st = jsonStatus{}
+	err = NewTokenDecoder(toks).Decode(&st)
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	assert.Equal(t, jsonStatus{Data: 100}, st)
+}
+
+func TestDecoderProcInst(t *testing.T) {
+	space := tagSpaceExamples[1]
+	// a PI before the root, one in the content of CARD, and one after the root
+	input := []byte{0x01, 0x01, 0x6A, 0x04, 'p', 'h', 'p', 0x00,
+		0x43, 0x06, 0x03, 'x', 0x00, 0x01,
+		0x45, 0x03, 'a', 0x00, 0x43, 0x04, 0x00, 0x03, 'e', 'c', 'h', 'o', 0x00, 0x01, 0x03, 'b', 0x00, 0x01,
+		0x43, 0x0A, 0x01}
+	toks, err := NewDecoder(bytes.NewReader(input), space.tags, space.attrs).DecodeAll()
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	expected := []Token{
+		ProcInst{Target: "TYPE", Inst: []byte("x")},
+		StartElement{Name: "CARD", Content: true, Offset: 14, StartOffset: 14, EndOffset: 15},
+		CharData("a"),
+		ProcInst{Target: "php", Inst: []byte("echo")},
+		CharData("b"),
+		EndElement{Name: "CARD", Offset: 32, StartOffset: 31, EndOffset: 32},
+		ProcInst{Target: "KEY", Inst: []byte{}},
+	}
+	assert.Equal(t, expected, toks)
+
+	// a PI has a single attribute
+	input = []byte{0x01, 0x01, 0x6A, 0x00, 0x43, 0x06, 0x03, 'x', 0x00, 0x0A, 0x01, 0x05}
+	_, err = NewDecoder(bytes.NewReader(input), space.tags, space.attrs).DecodeAll()
+	assert.NotNil(t, err)
+}
+
+func TestDecoderSwitchPageOnlyContent(t *testing.T) {
+	// Data whose content is only a switch to page 1, then EMI of page 1
+	input := []byte{0x03, 0x01, 0x6A, 0x00, 0x6D, 0x4F, 0x00, 0x01, 0x01, 0x06, 0x01}
+	for _, emit := range []bool{false, true} {
+		d := NewDecoder(bytes.NewReader(input), syncMLTags, CodeSpace{})
+		d.EmitSwitchPage = emit
+		toks, err := d.DecodeAll()
+		if err != nil {
+			t.Errorf("emit %v: unexpected error: %s", emit, err)
+		}
+		expected := []Token{
+			StartElement{Name: "SyncML", Content: true, Offset: 4, StartOffset: 4, EndOffset: 5},
+			StartElement{Name: "Data", Content: true, Offset: 5, StartOffset: 5, EndOffset: 6},
+			SwitchPage(1),
+			EndElement{Name: "Data", Offset: 9, StartOffset: 8, EndOffset: 9},
+			StartElement{Name: "EMI", Offset: 9, StartOffset: 9, EndOffset: 10},
+			EndElement{Name: "EMI", Offset: 10, StartOffset: 10, EndOffset: 10},
+			EndElement{Name: "SyncML", Offset: 11, StartOffset: 10, EndOffset: 11},
+		}
+		if !emit {
+			expected = append(expected[:2], expected[3:]...)
+		}
+		assert.Equal(t, expected, toks, "emit %v", emit)
+	}
+}
+
+type taggedHeader struct {
+	Ver      string `wbxml:"VerDTD"`
+	VerProto string
+	Reserved string `wbxml:"Reserved-1.0"`
+	Session  string `wbxml:"SessionID,trim"`
+	MsgID    string `wbxml:"Msg"`
+}
+
+func TestDecoderTagNames(t *testing.T) {
+	text := func(name, value string) []Token {
+		return []Token{StartElement{Name: name, Content: true}, CharData(value), EndElement{Name: name}}
+	}
+	toks := []Token{StartElement{Name: "SyncHdr", Content: true}}
+	toks = append(toks, text("VerDTD", "1.2")...)
+	toks = append(toks, text("VerProto", "m2m/1.2")...)
+	toks = append(toks, text("Reserved-1.0", "r")...)
+	toks = append(toks, text("SessionID", " S7eNe ")...)
+	// the field name does not match a field with a tag name
+	toks = append(toks, text("MsgID", "94")...)
+	toks = append(toks, text("Ver", "1.1")...)
+	toks = append(toks, EndElement{Name: "SyncHdr"})
+
+	var hdr taggedHeader
+	err := NewTokenDecoder(toks).Decode(&hdr)
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	expected := taggedHeader{Ver: "1.2", VerProto: "m2m/1.2", Reserved: "r", Session: "S7eNe"}
+	assert.Equal(t, expected, hdr)
+}
+
+func TestDecoderDecodeElementAttrs(t *testing.T) {
+	toks := []Token{
+		StartElement{Name: "Data", Attr: []Attr{{"TYPE", "int"}}, Content: true},
+		CharData("100"),
+		EndElement{Name: "Data"},
+	}
+	var data int
+	attrs, err := NewTokenDecoder(toks).DecodeElementAttrs(&data, nil)
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	assert.Equal(t, 100, data)
+	assert.Equal(t, []Attr{{"TYPE", "int"}}, attrs)
+
+	d := NewTokenDecoder(toks)
+	tok, err := d.Token()
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	start := tok.(StartElement)
+	var text string
+	attrs, err = d.DecodeElementAttrs(&text, &start)
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	assert.Equal(t, "100", text)
+	assert.Equal(t, []Attr{{"TYPE", "int"}}, attrs)
+}
+
+func TestDecoderDecodeWideNumbers(t *testing.T) {
+	// <Status><CmdID>1234</CmdID><MsgRef>4321</MsgRef></Status>
+	input := []byte{0x03, 0x01, 0x6A, 0x00, 0x69,
+		0x4B, 0x03, '1', '2', '3', '4', 0x00, 0x01,
+		0x5C, 0x03, '4', '3', '2', '1', 0x00, 0x01,
+		0x01}
+
+	var v struct {
+		CmdID  int32
+		MsgRef uint16
+	}
+	err := NewDecoder(bytes.NewReader(input), syncMLTags, CodeSpace{}).Decode(&v)
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	assert.Equal(t, int32(1234), v.CmdID)
+	assert.Equal(t, uint16(4321), v.MsgRef)
+}
+
+type intItem struct {
+	Value int
+}
+
+type textItem struct {
+	Value string
+}
+
+func TestDecoderDecodeRegisteredType(t *testing.T) {
+	toks := []Token{
+		StartElement{Name: "Items", Content: true},
+		StartElement{Name: "Item", Attr: []Attr{{"TYPE", "int"}}, Content: true},
+		StartElement{Name: "Value", Content: true}, CharData("500"), EndElement{Name: "Value"},
+		EndElement{Name: "Item"},
+		StartElement{Name: "Item", Attr: []Attr{{"TYPE", "text"}}, Content: true},
+		StartElement{Name: "Value", Content: true}, CharData("abc"), EndElement{Name: "Value"},
+		EndElement{Name: "Item"},
+		EndElement{Name: "Items"},
+	}
+	var v struct {
+		Item []interface{}
+	}
+	d := NewTokenDecoder(toks)
+	d.RegisterType("Item", "TYPE", "int", intItem{})
+	d.RegisterType("Item", "TYPE", "text", &textItem{})
+	err := d.Decode(&v)
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	assert.Equal(t, []interface{}{intItem{Value: 500}, &textItem{Value: "abc"}}, v.Item)
+
+	d = NewTokenDecoder(toks)
+	d.RegisterType("Item", "TYPE", "int", intItem{})
+	err = d.Decode(&v)
+	assert.NotNil(t, err)
+}
+
+func TestDecoderCharDataInitialized(t *testing.T) {
+	// an empty inline string
+	d := NewDecoder(bytes.NewReader([]byte{0x00}), CodeSpace{}, CodeSpace{})
+	var cdata CharData
+	d.charData(&cdata, gloStrI)
+	assert.NotNil(t, cdata)
+	assert.Equal(t, CharData{}, cdata)
+}
+
+func TestDecoderMaxTokens(t *testing.T) {
+	// <SyncBody> with 100 empty <Final/>
+	input := []byte{0x03, 0x01, 0x6A, 0x00, 0x6B}
+	for i := 0; i < 100; i++ {
+		input = append(input, 0x12)
+	}
+	input = append(input, 0x01)
+
+	d := NewBytesDecoder(input, syncMLTags, CodeSpace{})
+	d.MaxTokens = 50
+	toks, err := d.DecodeAll()
+	assert.NotNil(t, err)
+	assert.Equal(t, 50, len(toks))
+
+	d = NewBytesDecoder(input, syncMLTags, CodeSpace{})
+	d.MaxTokens = 202
+	toks, err = d.DecodeAll()
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	assert.Equal(t, 202, len(toks))
+}
+
+func TestDecoderStreamOpaqueFields(t *testing.T) {
+	encode := func(toks ...Token) []byte {
+		w := bytes.NewBuffer(nil)
+		e := NewEncoder(w, syncMLTags, CodeSpace{})
+		err := e.EncodeHeader(Header{Version: 3, PublicID: 1, Charset: 106})
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		for _, tok := range toks {
+			err := e.EncodeToken(tok)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+		}
+		return w.Bytes()
+	}
+	data := func(toks ...Token) []byte {
+		toks = append([]Token{StartElement{Name: "SyncML", Content: true}, StartElement{Name: "Data", Content: true}}, toks...)
+		return encode(append(toks, EndElement{Name: "Data"}, EndElement{Name: "SyncML"})...)
+	}
+
+	var str struct{ Data string }
+	var chunks struct{ Data [][]byte }
+	var number struct {
+		Data int `wbxml:",opaque"`
+	}
+	var text struct {
+		Text string `wbxml:",chardata"`
+	}
+	tests := []struct {
+		input    []byte
+		v        interface{}
+		expected interface{}
+	}{
+		{data(Opaque("abc")), &str, &struct{ Data string }{"abc"}},
+		{data(Opaque("ab"), Opaque("c")), &chunks, &struct{ Data [][]byte }{[][]byte{[]byte("ab"), []byte("c")}}},
+		{data(Opaque{0x01, 0x02}), &number, &struct {
+			Data int `wbxml:",opaque"`
+		}{0x0102}},
+		{encode(StartElement{Name: "SyncML", Content: true}, Opaque("abc"), EndElement{Name: "SyncML"}), &text, &struct {
+			Text string `wbxml:",chardata"`
+		}{"abc"}},
+	}
+	for testID, test := range tests {
+		d := NewBytesDecoder(test.input, syncMLTags, CodeSpace{})
+		d.StreamOpaque = true
+		err := d.Decode(test.v)
+		if err != nil {
+			t.Errorf("case %d: unexpected error: %s", testID, err)
+		}
+		assert.Equal(t, test.expected, test.v, "case %d", testID)
+	}
+}
@@ -1,16 +1,28 @@
 package wbxml
 
 import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"math/big"
 	"reflect"
 	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding"
 )
 
 // Unmarshaler is an interface implemented by a type that wish to control how it is
 // decoded from WBXML.
 //
 // Mostly used when a type is not supported by default by Decoder.DecodeElement.
+//
+// UnmarshalWBXML must consume the tokens of the element up to and including its end
+// element, else decoding fails.
 type Unmarshaler interface {
 	UnmarshalWBXML(d *Decoder, st *StartElement) error
 }
@@ -25,12 +37,95 @@ type Decoder struct {
 	attrs    CodeSpace
 
 	offset  int
+	depth   int
+	count   int  // tokens emitted, checked against MaxTokens
+	open    int  // elements open in the stream, counted by the goroutine decoding it
+	rootEnd bool // the root element ended, and the goroutine decoding it returned
+	raw     *bytes.Buffer
+	replay  bool
+	tokens  []Token
+	started bool
+	done    bool
+	peeked  bool
+	next    Token
+	nextErr error
+	last    Token // last token returned by Token, the only one UnreadToken accepts
 	tokChan chan Token
+	resume  chan struct{}
 	err     error
+	enums   map[reflect.Type]map[string]int64
+	opaques map[string]func(Opaque) (Opaque, error)
+	types   map[typeKey]reflect.Type
+	text    *encoding.Decoder // converts the inline strings
+	tabText *encoding.Decoder // converts the entries of the string table
+	wide    bool              // strings end with a NUL code unit of two bytes, in UTF-16
+	src     *bytes.Reader     // source of a decoder created by NewBytesDecoder
+	srcData []byte
 	Header  Header
+
+	// DefaultCharset is the charset of the strings of a document whose header charset
+	// is unknown. If nil, such strings are read as-is, unless Strict is set.
+	DefaultCharset encoding.Encoding
+
+	// SkipLeading makes the decoder skip any leading byte that is not a known WBXML
+	// version, for documents prefixed with stray bytes such as a BOM. Without it,
+	// such a byte is reported as an error.
+	SkipLeading bool
+
+	// MaxMbUintBytes is the maximum number of bytes of the multi-byte integers (lengths,
+	// indexes, entities...) of the document, for profiles using more than the 4 bytes
+	// allowed by default. It is capped to 10 bytes, and the value must still fit in 32 bits.
+	MaxMbUintBytes int
+
+	// MaxTokens, if not 0, is the maximum number of tokens of the document, so that a
+	// document of untrusted source made of many small elements cannot exhaust memory
+	// once decoded by DecodeAll or into a slice. Decoding fails past this count.
+	MaxTokens int
+
+	// EmitSwitchPage makes the decoder return a SwitchPage token for each SWITCH_PAGE
+	// between the elements. SWITCH_PAGE in attribute lists are not returned.
+	EmitSwitchPage bool
+
+	// StreamOpaque makes the decoder return an OpaqueReader instead of an Opaque, so
+	// that large opaque data can be read without being loaded in memory. DecodeElement
+	// still reads the whole opaque of a field, as it does for an Opaque.
+	StreamOpaque bool
+
+	// FoldOpaque makes the decoder concatenate an opaque adjacent to a string or an entity
+	// to the surrounding CharData, as if it were text. An opaque that is not adjacent to
+	// text is still returned as an Opaque, and never as an OpaqueReader.
+	FoldOpaque bool
+
+	// NumberCleaner, if set, is applied to a numeric CharData before it is parsed to an
+	// integer or a float, to remove thousands separators or units for example.
+	NumberCleaner func(string) string
+
+	// Warnings collects the non fatal issues of the document, where decoding may lose
+	// information: entities and extensions flattened into attribute values, charset
+	// substituted by DefaultCharset, and multi-byte integers not in their minimal form.
+	Warnings []Warning
+
+	// JSONTags makes the decoder match a child element to the name of the json tag of a
+	// struct field, if no field has the name of the element and the field has no
+	// wbxml tag, so that structs annotated for encoding/json decode as they are.
+	JSONTags bool
+
+	// Strict makes the decoder reject constructs that are tolerated by default: multi-byte
+	// integers that are not in their minimal form, SWITCH_PAGE to a code page missing
+	// from the CodeSpace, bytes following the document, entities that are not valid
+	// code points (replaced by U+FFFD in CharData otherwise), and unknown charsets
+	// without a DefaultCharset.
+	Strict bool
+
+	// LenientAttrs makes the decoder name an attribute code missing from the attribute
+	// CodeSpace Unknown_0xNN, with a warning, instead of reporting an error. Such names
+	// cannot be encoded back.
+	LenientAttrs bool
 }
 
 // NewDecoder instantiate a Decoder, with r as a stream of WBXML.
+// Reading starts with the first call to Token, so the options of the Decoder can be
+// set until then.
 func NewDecoder(r io.Reader, tags CodeSpace, attrs CodeSpace) *Decoder {
 	d := &Decoder{
 		r: r,
@@ -38,38 +133,288 @@ func NewDecoder(r io.Reader, tags CodeSpace, attrs CodeSpace) *Decoder {
 		tags:    tags,
 		attrs:   attrs,
 		tokChan: make(chan Token),
+		resume:  make(chan struct{}),
 	}
 
-	go d.run()
 	return d
 }
 
+// NewTokenDecoder instantiates a Decoder yielding toks, as returned by DecodeAll.
+// It allows decoding the same document several times without parsing it again.
+func NewTokenDecoder(toks []Token) *Decoder {
+	d := &Decoder{
+		replay: true,
+		tokens: toks,
+	}
+
+	return d
+}
+
+// NewBytesDecoder instantiates a Decoder reading the WBXML document data. The inline
+// strings and opaques of the document are not copied: the CharData and Opaque tokens,
+// and the []byte and Opaque fields decoded from them, may alias data, and must not be
+// retained if data is modified.
+func NewBytesDecoder(data []byte, tags CodeSpace, attrs CodeSpace) *Decoder {
+	d := NewDecoder(bytes.NewReader(data), tags, attrs)
+	d.src = d.r.(*bytes.Reader)
+	d.srcData = data
+	return d
+}
+
+// RegisterEnum registers the mapping from attribute value names to the constants of
+// the integer type of v. A `wbxml:",attr"` field of that type is then decoded by
+// looking up the attribute value in values. It returns an error if v is not an integer.
+func (d *Decoder) RegisterEnum(v interface{}, values map[string]int64) error {
+	t := reflect.TypeOf(v)
+	if t == nil {
+		return fmt.Errorf("enum of nil type")
+	}
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+	default:
+		return fmt.Errorf("enum of non integer type %s", t)
+	}
+	if d.enums == nil {
+		d.enums = make(map[reflect.Type]map[string]int64)
+	}
+	d.enums[t] = values
+	return nil
+}
+
+// typeKey identifies the elements decoded to a type registered with RegisterType.
+type typeKey struct {
+	name, attr, value string
+}
+
+// RegisterType registers the type of v as the concrete type of the elements named name
+// whose attribute attr has the given value, such as a TYPE or xsi:type discriminator.
+// An interface field, or an element of an interface slice, receiving such an element is
+// set to a new value of that type.
+func (d *Decoder) RegisterType(name, attr, value string, v interface{}) {
+	if d.types == nil {
+		d.types = make(map[typeKey]reflect.Type)
+	}
+	d.types[typeKey{name, attr, value}] = reflect.TypeOf(v)
+}
+
+// RegisterOpaque registers handler to convert the opaques in the content of the elements
+// named name, before they are returned by Token. It does not apply to the opaques read
+// with StreamOpaque or FoldOpaque.
+func (d *Decoder) RegisterOpaque(name string, handler func(Opaque) (Opaque, error)) {
+	if d.opaques == nil {
+		d.opaques = make(map[string]func(Opaque) (Opaque, error))
+	}
+	d.opaques[name] = handler
+}
+
+// Base64Opaque is an opaque handler for RegisterOpaque, decoding an opaque holding base64
+// text, as sent by some ActiveSync servers, to the raw bytes.
+func Base64Opaque(opaque Opaque) (Opaque, error) {
+	data := make([]byte, base64.StdEncoding.DecodedLen(len(opaque)))
+	n, err := base64.StdEncoding.Decode(data, bytes.TrimSpace(opaque))
+	if err != nil {
+		return nil, fmt.Errorf("invalid base64 opaque: %s", err)
+	}
+	return data[:n], nil
+}
+
+// ExtensionString returns the string of the string table referenced by the inline integer
+// extension ext, for document types using EXT_T as a reference to the string table.
+// In an attribute value, such an extension is always resolved by ExtensionString.
+func (d *Decoder) ExtensionString(ext Extension) ([]byte, error) {
+	if ext.Kind != ExtInteger {
+		return nil, fmt.Errorf("EXT_%d is not an inline integer extension", ext.ID)
+	}
+	str, err := d.GetString(ext.Index)
+	if err != nil {
+		return nil, err
+	}
+	return d.convertTable(str)
+}
+
 // GetString returns the string of the string table starting at byte i and ending a the first
 // meet NULL terminator. It returns nil and error if i bigger than the string table, or no NULL
 // terminator is found.
 func (d *Decoder) GetString(i uint32) ([]byte, error) {
+	if len(d.Header.StringTable) == 0 {
+		return nil, fmt.Errorf("reference %d to the string table, but the document has no string table", i)
+	}
 	if i >= uint32(len(d.Header.StringTable)) {
 		return nil, fmt.Errorf("%d is not a valid string reference (max %d)", i, len(d.Header.StringTable))
 	}
-	for end, b := range d.Header.StringTable[i:] {
-		if b == 0 {
-			return d.Header.StringTable[i : i+uint32(end)], nil
-		}
+	end := d.stringEnd(d.Header.StringTable[i:])
+	if end < 0 {
+		return nil, fmt.Errorf("StringTable: no NULL terminator found")
 	}
-	return nil, fmt.Errorf("StringTable: no NULL terminator found")
+	return d.Header.StringTable[i : i+uint32(end)], nil
 }
 
 // Token returns the next token in the WBXML stream, or an error.
 // At end it returns nil and io.EOF.
 // It is mostly used by types implementing Unmarshaler.
 func (d *Decoder) Token() (Token, error) {
+	tok, err := d.Peek()
+	d.peeked = false
+	d.last = nil
+	if err != nil {
+		return tok, err
+	}
+	d.last = tok
+	switch tok.(type) {
+	case StartElement:
+		d.depth++
+	case EndElement:
+		d.depth--
+	}
+	return tok, nil
+}
+
+// Peek returns the next token in the WBXML stream, or an error, without consuming it:
+// the token is returned again by the next call to Token.
+// As the token is already read, the state of the decoder is the one after it.
+func (d *Decoder) Peek() (Token, error) {
+	if !d.peeked {
+		d.next, d.nextErr = d.readToken()
+		d.peeked = true
+	}
+	return d.next, d.nextErr
+}
+
+// UnreadToken gives back tok, the last token returned by Token, so that it is returned
+// again by the next call to Token. It allows an Unmarshaler to leave a token it does not
+// handle to its caller. Only one token can be unread, and not after a call to Peek.
+// Any other token is rejected, as the decoder would not be in the state following it.
+func (d *Decoder) UnreadToken(tok Token) error {
+	if d.peeked {
+		return fmt.Errorf("a token is already unread")
+	}
+	if d.last == nil || !reflect.DeepEqual(tok, d.last) {
+		return fmt.Errorf("%s is not the last token returned by Token", tokenString(tok))
+	}
+	d.last = nil
+	switch tok.(type) {
+	case StartElement:
+		d.depth--
+	case EndElement:
+		d.depth++
+	}
+	d.next, d.nextErr = tok, nil
+	d.peeked = true
+	return nil
+}
+
+// readToken reads the next token from the goroutine decoding the stream.
+func (d *Decoder) readToken() (Token, error) {
+	if d.done {
+		return nil, d.err
+	}
+	if d.replay {
+		if len(d.tokens) == 0 {
+			d.done, d.err = true, io.EOF
+			return nil, d.err
+		}
+		tok := d.tokens[0]
+		d.tokens = d.tokens[1:]
+		return tok, nil
+	}
+	switch {
+	case !d.started:
+		d.started = true
+		go d.run()
+	case d.rootEnd:
+		// the goroutine decoding the root element returned after its end
+		d.rootEnd = false
+		go d.trailer()
+	default:
+		d.resume <- struct{}{}
+	}
 	tok := <-d.tokChan
 	if tok == nil {
+		d.done = true
 		return tok, d.err
 	}
 	return tok, nil
 }
 
+// emit sends tok to Token, and waits for the next call to Token before reading further.
+// The state of the decoder is thus stable between two calls to Token. The end of the root
+// element is not followed by a wait, since the caller may stop there: the goroutine
+// returns instead, and readToken starts a new one for the rest of the stream.
+func (d *Decoder) emit(tok Token) {
+	d.count++
+	if d.MaxTokens > 0 && d.count > d.MaxTokens {
+		d.panicErr(fmt.Errorf("document of more than %d tokens", d.MaxTokens))
+	}
+	last := d.rootEnd
+	d.tokChan <- tok
+	if !last {
+		<-d.resume
+	}
+}
+
+// RawElement returns the undecoded bytes of the element started by start, from the end
+// of its start tag up to and including its end tag, and consumes the tokens of the element.
+// start must be the last token returned by Token. It is mostly used by types implementing
+// Unmarshaler to decode a sub-format embedded in an element.
+func (d *Decoder) RawElement(start *StartElement) ([]byte, error) {
+	d.raw = bytes.NewBuffer(nil)
+	defer func() { d.raw = nil }()
+
+	depth := 1
+	for {
+		tok, err := d.Token()
+		if err != nil {
+			return nil, err
+		}
+		switch tok := tok.(type) {
+		case StartElement:
+			depth++
+		case EndElement:
+			depth--
+			if depth == 0 {
+				if tok.Name != start.Name {
+					return nil, fmt.Errorf("expected end element %s, got %s", start.Name, tok.Name)
+				}
+				return d.raw.Bytes(), nil
+			}
+		}
+	}
+}
+
+// DecodeAll returns all the tokens of the WBXML stream, up to the end of the document.
+// An OpaqueReader is read to an Opaque, since it would not be valid afterward.
+func (d *Decoder) DecodeAll() ([]Token, error) {
+	var toks []Token
+	for {
+		tok, err := d.Token()
+		if err == io.EOF {
+			return toks, nil
+		}
+		if err != nil {
+			return toks, err
+		}
+		tok, err = readOpaque(tok)
+		if err != nil {
+			return toks, err
+		}
+		toks = append(toks, tok)
+	}
+}
+
+// Stream sends the tokens of the WBXML stream to ch until the end of the document or
+// an error. ch is neither created nor closed by Stream, the caller owns it.
+// It returns io.EOF at the end of the document, else the error that stopped decoding.
+func (d *Decoder) Stream(ch chan<- Token) error {
+	for {
+		tok, err := d.Token()
+		if err != nil {
+			return err
+		}
+		ch <- tok
+	}
+}
+
 // Decode decodes a WBXML document to v.
 func (d *Decoder) Decode(v interface{}) error {
 	return d.DecodeElement(v, nil)
@@ -78,16 +423,78 @@ func (d *Decoder) Decode(v interface{}) error {
 // DecodeElement decodes the root element and its child to v.
 // It is mostly used by types implementing Unmarshaler that wish to
 // delegate parts of the decoding.
+//
+// A non-nil start must be the StartElement last returned by Token: a StartElement
+// only returned by Peek is not consumed yet, and is decoded by passing a nil start.
+// Otherwise an Unmarshaler reads start again and is reported as not stopping at its
+// end element.
+//
+// A []byte receives the bytes of a CharData or an Opaque as-is: numeric CharData
+// such as "500" is stored as its ASCII digits, not parsed. A []byte field tagged
+// `wbxml:",opaque"` only accepts an Opaque and rejects any other content, while an integer
+// field tagged `wbxml:",opaque"` also accepts a big-endian Opaque. The leading
+// and trailing white space of the CharData of a string or []byte field tagged
+// `wbxml:",trim"` is removed.
+//
+// A struct field tagged `wbxml:",attr"` receives the value of the attribute of the same
+// name, either as a string or as an enum registered with RegisterEnum, and a []Attr field
+// tagged `wbxml:",attrs"` receives all the attributes of the element. A string or []byte
+// field tagged `wbxml:",chardata"` receives the text directly contained by the element.
+// A map[string]bool or []string field tagged `wbxml:",seen"` receives the names of the
+// child elements, decoded to a field or not, and a string field tagged `wbxml:",name"` the
+// name of the element itself. An interface receives a value of the type registered with
+// RegisterType for the element and its attributes.
 func (d *Decoder) DecodeElement(v interface{}, start *StartElement) error {
+	return d.decodeElement(v, start, "")
+}
+
+// DecodeElementAttrs works like DecodeElement, and also returns the attributes of the
+// element, which are otherwise lost when it decodes into a scalar such as a string or an
+// integer.
+func (d *Decoder) DecodeElementAttrs(v interface{}, start *StartElement) ([]Attr, error) {
 	if start == nil {
-		tok, err := d.Token()
+		var err error
+		start, err = d.startElement()
 		if err != nil {
-			return err
+			return nil, err
 		}
-		if st, ok := tok.(StartElement); ok {
-			start = &st
-		} else {
-			return fmt.Errorf("expected a StartElement, got %t", tok)
+	}
+	return start.Attr, d.DecodeElement(v, start)
+}
+
+// startElement reads the next token, which must be a StartElement.
+func (d *Decoder) startElement() (*StartElement, error) {
+	tok, err := d.Token()
+	if err != nil {
+		return nil, err
+	}
+	st, ok := tok.(StartElement)
+	if !ok {
+		return nil, fmt.Errorf("expected a StartElement, got %s", tokenString(tok))
+	}
+	return &st, nil
+}
+
+// DecodeElementWith works like DecodeElement, but decodes the content of the element with
+// the tags and attrs code spaces instead of the ones of the decoder, for a subtree of a
+// different profile embedded in the document. The code pages start at 0 in the subtree,
+// and the code spaces and pages of the decoder are restored once the element is decoded.
+// A token already returned by Peek is not affected.
+func (d *Decoder) DecodeElementWith(v interface{}, start *StartElement, tags, attrs CodeSpace) error {
+	outerTags, tagPage, outerAttrs, attrPage := d.tags, d.tagPage, d.attrs, d.attrPage
+	d.tags, d.tagPage, d.attrs, d.attrPage = tags, 0, attrs, 0
+	defer func() {
+		d.tags, d.tagPage, d.attrs, d.attrPage = outerTags, tagPage, outerAttrs, attrPage
+	}()
+	return d.DecodeElement(v, start)
+}
+
+func (d *Decoder) decodeElement(v interface{}, start *StartElement, opts tagOptions) error {
+	if start == nil {
+		var err error
+		start, err = d.startElement()
+		if err != nil {
+			return err
 		}
 	}
 
@@ -95,23 +502,60 @@ func (d *Decoder) DecodeElement(v interface{}, start *StartElement) error {
 	if val.Kind() == reflect.Interface && !val.IsNil() {
 		val = val.Elem()
 	}
-	if val.Kind() == reflect.Ptr {
+	// allocate every pointer level, checking for an Unmarshaler at each of them
+	for val.Kind() == reflect.Ptr {
 		if val.IsNil() {
 			val.Set(reflect.New(val.Type().Elem()))
 		}
 		if un, ok := val.Interface().(Unmarshaler); ok {
-			return un.UnmarshalWBXML(d, start)
+			depth := d.depth
+			err := un.UnmarshalWBXML(d, start)
+			if err != nil {
+				return err
+			}
+			if d.depth != depth-1 {
+				return fmt.Errorf("%T.UnmarshalWBXML did not stop at the end element %s", un, start.Name)
+			}
+			return nil
 		}
 		val = val.Elem()
 	}
 
+	if val.Kind() == reflect.Interface {
+		return d.decodeInterface(val, start, opts)
+	}
+
+	if val.Type() == bigIntType {
+		return d.decodeBigInt(val.Addr().Interface().(*big.Int), start)
+	}
+
 	switch t := val.Type(); val.Kind() {
 	case reflect.Struct:
+		if err := d.decodeAttrs(val, start); err != nil {
+			return err
+		}
+		if name := fieldWithOption(t, "name"); name >= 0 {
+			if val.Field(name).Kind() != reflect.String {
+				return fmt.Errorf("field %s: ,name expected a string, got %s", t.Field(name).Name, val.Field(name).Type())
+			}
+			val.Field(name).SetString(start.Name)
+		}
+		text := fieldWithOption(t, "chardata")
+		seen := fieldWithOption(t, "seen")
 		for {
 			tok, err := d.Token()
 			if err != nil {
 				return err
 			}
+			if text >= 0 {
+				tok, err = readOpaque(tok)
+				if err != nil {
+					return fmt.Errorf("field %s: %s", t.Field(text).Name, err)
+				}
+				if err := appendText(val.Field(text), tok); err != nil {
+					return fmt.Errorf("field %s: %s", t.Field(text).Name, err)
+				}
+			}
 			if end, ok := tok.(EndElement); ok {
 				if end.Name == start.Name {
 					return nil
@@ -119,8 +563,15 @@ func (d *Decoder) DecodeElement(v interface{}, start *StartElement) error {
 				return fmt.Errorf("expected end element %s, got %s", start.Name, end.Name)
 			}
 			if st, ok := tok.(StartElement); ok {
-				if _, ok := t.FieldByName(st.Name); ok {
-					fld := val.FieldByName(st.Name)
+				if seen >= 0 {
+					if err := recordSeen(val.Field(seen), st.Name); err != nil {
+						return fmt.Errorf("field %s: %s", t.Field(seen).Name, err)
+					}
+				}
+				sf, ok := d.elementField(t, st.Name)
+				_, fopts := parseTag(sf.Tag.Get("wbxml"))
+				if ok && fopts.isElement() {
+					fld := val.FieldByIndex(sf.Index)
 					if fld.Kind() == reflect.Ptr && fld.IsNil() {
 						fld.Set(reflect.New(fld.Type().Elem()))
 					}
@@ -128,7 +579,7 @@ func (d *Decoder) DecodeElement(v interface{}, start *StartElement) error {
 						fld = fld.Addr()
 					}
 					if fld.CanInterface() {
-						err := d.DecodeElement(fld.Interface(), &st)
+						err := d.decodeElement(fld.Interface(), &st, fopts)
 						if err != nil {
 							return err
 						}
@@ -154,7 +605,18 @@ func (d *Decoder) DecodeElement(v interface{}, start *StartElement) error {
 		if err != nil {
 			return err
 		}
+		tok, err = readOpaque(tok)
+		if err != nil {
+			return fmt.Errorf("field %s: %s", start.Name, err)
+		}
+		if isEnd(tok, start) {
+			val.SetString("")
+			return nil
+		}
 		if cdata, ok := tok.(CharData); ok {
+			if opts.Contains("trim") {
+				cdata = bytes.TrimSpace(cdata)
+			}
 			val.SetString(string(cdata))
 			return d.expectedEnd(start)
 		}
@@ -162,21 +624,41 @@ func (d *Decoder) DecodeElement(v interface{}, start *StartElement) error {
 			val.SetString(string(opaque))
 			return d.expectedEnd(start)
 		}
-		return fmt.Errorf("string expected a CharData, got %t", tok)
+		return fmt.Errorf("string expected a CharData, got %s", tokenString(tok))
 	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
 		tok, err := d.Token()
 		if err != nil {
 			return err
 		}
+		tok, err = readOpaque(tok)
+		if err != nil {
+			return fmt.Errorf("field %s: %s", start.Name, err)
+		}
+		if isEnd(tok, start) {
+			val.Set(reflect.Zero(t))
+			return nil
+		}
 		switch itok := tok.(type) {
 		case Entity:
+			if val.OverflowUint(uint64(itok)) {
+				return fmt.Errorf("field %s: entity %d overflows %s", start.Name, uint32(itok), t)
+			}
 			val.SetUint(uint64(itok))
 		case CharData:
-			i, err := strconv.ParseUint(string(itok), 10, 8)
+			i, err := strconv.ParseUint(d.number(itok), 10, t.Bits())
 			if err != nil {
 				return fmt.Errorf("field %s: %s", start.Name, err)
 			}
 			val.SetUint(i)
+		case Opaque:
+			if !opts.Contains("opaque") {
+				return fmt.Errorf("expected a number, got %T", tok)
+			}
+			u, err := opaqueUint(itok, t.Bits())
+			if err != nil {
+				return fmt.Errorf("field %s: %s", start.Name, err)
+			}
+			val.SetUint(u)
 		default:
 			return fmt.Errorf("expected a number, got %T", tok)
 		}
@@ -186,15 +668,60 @@ func (d *Decoder) DecodeElement(v interface{}, start *StartElement) error {
 		if err != nil {
 			return err
 		}
+		tok, err = readOpaque(tok)
+		if err != nil {
+			return fmt.Errorf("field %s: %s", start.Name, err)
+		}
+		if isEnd(tok, start) {
+			val.Set(reflect.Zero(t))
+			return nil
+		}
 		switch itok := tok.(type) {
 		case Entity:
+			// an entity is unsigned, negative values can only be written as CharData
+			if val.OverflowInt(int64(itok)) {
+				return fmt.Errorf("field %s: entity %d overflows %s", start.Name, uint32(itok), t)
+			}
 			val.SetInt(int64(itok))
 		case CharData:
-			i, err := strconv.ParseInt(string(itok), 10, 8)
+			i, err := strconv.ParseInt(d.number(itok), 10, t.Bits())
 			if err != nil {
 				return fmt.Errorf("field %s: %s", start.Name, err)
 			}
 			val.SetInt(i)
+		case Opaque:
+			if !opts.Contains("opaque") {
+				return fmt.Errorf("expected a number, got %T", tok)
+			}
+			u, err := opaqueUint(itok, t.Bits())
+			if err != nil {
+				return fmt.Errorf("field %s: %s", start.Name, err)
+			}
+			// sign extension of the opaque two's complement
+			shift := uint(64 - 8*len(itok))
+			val.SetInt(int64(u<<shift) >> shift)
+		default:
+			return fmt.Errorf("expected a number, got %T", tok)
+		}
+		return d.expectedEnd(start)
+	case reflect.Float32, reflect.Float64:
+		tok, err := d.Token()
+		if err != nil {
+			return err
+		}
+		if isEnd(tok, start) {
+			val.Set(reflect.Zero(t))
+			return nil
+		}
+		switch itok := tok.(type) {
+		case Entity:
+			val.SetFloat(float64(itok))
+		case CharData:
+			f, err := strconv.ParseFloat(d.number(itok), t.Bits())
+			if err != nil {
+				return fmt.Errorf("field %s: %s", start.Name, err)
+			}
+			val.SetFloat(f)
 		default:
 			return fmt.Errorf("expected a number, got %T", tok)
 		}
@@ -209,18 +736,44 @@ func (d *Decoder) DecodeElement(v interface{}, start *StartElement) error {
 			if err != nil {
 				return err
 			}
-			if cdata, ok := tok.(CharData); ok {
-				val.Set(reflect.AppendSlice(val, reflect.ValueOf(cdata)))
-				return d.expectedEnd(start)
+			if isEnd(tok, start) {
+				return nil
 			}
 			if opaque, ok := tok.(Opaque); ok {
 				val.Set(reflect.AppendSlice(val, reflect.ValueOf(opaque)))
 				return d.expectedEnd(start)
 			}
-			if end, ok := tok.(EndElement); ok && end.Name == start.Name {
-				return nil
+			if opaque, ok := tok.(OpaqueReader); ok {
+				data, err := ioutil.ReadAll(opaque)
+				if err != nil {
+					return fmt.Errorf("field %s: %s", start.Name, err)
+				}
+				val.Set(reflect.AppendSlice(val, reflect.ValueOf(data)))
+				return d.expectedEnd(start)
+			}
+			if opts.Contains("opaque") {
+				return fmt.Errorf("field %s: ,opaque expected an Opaque, got %T", start.Name, tok)
 			}
-			return fmt.Errorf("[]byte expected a CharData, got %t", tok)
+			if cdata, ok := tok.(CharData); ok {
+				if opts.Contains("trim") {
+					cdata = bytes.TrimSpace(cdata)
+				}
+				data, err := decodeBinaryText(cdata, opts)
+				if err != nil {
+					return fmt.Errorf("field %s: %s", start.Name, err)
+				}
+				val.Set(reflect.AppendSlice(val, reflect.ValueOf(data)))
+				return d.expectedEnd(start)
+			}
+			return fmt.Errorf("[]byte expected a CharData, got %s", tokenString(tok))
+		}
+
+		if t.Elem().Kind() == reflect.Slice && t.Elem().Elem().Kind() == reflect.Uint8 {
+			return d.decodeChunks(val, start)
+		}
+
+		if sep, ok := opts.Value("split"); ok && t.Elem().Kind() == reflect.String {
+			return d.decodeSplit(val, start, sep)
 		}
 
 		// Append element to slice
@@ -228,17 +781,392 @@ func (d *Decoder) DecodeElement(v interface{}, start *StartElement) error {
 		val.Set(reflect.Append(val, reflect.Zero(t.Elem())))
 
 		// Decode element, remove it if failed
-		if err := d.DecodeElement(val.Index(n).Addr().Interface(), start); err != nil {
+		if err := d.decodeElement(val.Index(n).Addr().Interface(), start, opts); err != nil {
 			val.SetLen(n)
 			return err
 		}
 		return nil
 
+	case reflect.Map:
+		return d.decodeMap(val, start)
+
 	default:
 		return fmt.Errorf("%s not implemented", t.Kind())
 	}
 }
 
+// decodeInterface sets the interface val to a new value of the type registered with
+// RegisterType for the attributes of start, decoded from the element.
+func (d *Decoder) decodeInterface(val reflect.Value, start *StartElement, opts tagOptions) error {
+	var typ reflect.Type
+	for _, attr := range start.Attr {
+		if t, ok := d.types[typeKey{start.Name, attr.Name, attr.Value}]; ok {
+			typ = t
+			break
+		}
+	}
+	if typ == nil {
+		return fmt.Errorf("field %s: no type registered for %s", start.Name, val.Type())
+	}
+	if !typ.AssignableTo(val.Type()) {
+		return fmt.Errorf("field %s: registered type %s does not implement %s", start.Name, typ, val.Type())
+	}
+	elem := reflect.New(typ)
+	if err := d.decodeElement(elem.Interface(), start, opts); err != nil {
+		return err
+	}
+	val.Set(elem.Elem())
+	return nil
+}
+
+// decodeMap sets an entry of the map val for each child element of start, from its name
+// to its decoded value. Text and opaque between the child elements are ignored.
+func (d *Decoder) decodeMap(val reflect.Value, start *StartElement) error {
+	t := val.Type()
+	if t.Key().Kind() != reflect.String {
+		return fmt.Errorf("field %s: map expected string keys, got %s", start.Name, t.Key())
+	}
+	if val.IsNil() {
+		val.Set(reflect.MakeMap(t))
+	}
+	for {
+		tok, err := d.Token()
+		if err != nil {
+			return err
+		}
+		switch itok := tok.(type) {
+		case EndElement:
+			if itok.Name != start.Name {
+				return fmt.Errorf("expected end element %s, got %s", start.Name, itok.Name)
+			}
+			return nil
+		case StartElement:
+			elem := reflect.New(t.Elem())
+			err := d.decodeElement(elem.Interface(), &itok, "")
+			if err != nil {
+				return err
+			}
+			val.SetMapIndex(reflect.ValueOf(itok.Name).Convert(t.Key()), elem.Elem())
+		}
+	}
+}
+
+// decodeSplit appends to the []string val the parts of the CharData of the element,
+// split on sep. Empty parts are dropped.
+func (d *Decoder) decodeSplit(val reflect.Value, start *StartElement, sep string) error {
+	tok, err := d.Token()
+	if err != nil {
+		return err
+	}
+	if isEnd(tok, start) {
+		return nil
+	}
+	cdata, ok := tok.(CharData)
+	if !ok {
+		return fmt.Errorf("field %s: ,split expected a CharData, got %s", start.Name, tokenString(tok))
+	}
+	for _, part := range strings.Split(string(cdata), sep) {
+		if part != "" {
+			val.Set(reflect.Append(val, reflect.ValueOf(part).Convert(val.Type().Elem())))
+		}
+	}
+	return d.expectedEnd(start)
+}
+
+// decodeChunks appends each CharData or Opaque of the element to the [][]byte val.
+func (d *Decoder) decodeChunks(val reflect.Value, start *StartElement) error {
+	elem := val.Type().Elem()
+	for {
+		tok, err := d.Token()
+		if err != nil {
+			return err
+		}
+		tok, err = readOpaque(tok)
+		if err != nil {
+			return fmt.Errorf("field %s: %s", start.Name, err)
+		}
+		switch itok := tok.(type) {
+		case Opaque:
+			val.Set(reflect.Append(val, reflect.ValueOf([]byte(itok)).Convert(elem)))
+		case CharData:
+			val.Set(reflect.Append(val, reflect.ValueOf([]byte(itok)).Convert(elem)))
+		case EndElement:
+			if itok.Name == start.Name {
+				return nil
+			}
+			return fmt.Errorf("expected end element %s, got %s", start.Name, itok.Name)
+		default:
+			return fmt.Errorf("[][]byte expected an Opaque, got %T", tok)
+		}
+	}
+}
+
+var bigIntType = reflect.TypeOf(big.Int{})
+
+// decodeBigInt decodes an Entity or a decimal CharData of any length to i, cleaned by
+// NumberCleaner. An element without content decodes to 0, as for the other numbers.
+func (d *Decoder) decodeBigInt(i *big.Int, start *StartElement) error {
+	tok, err := d.Token()
+	if err != nil {
+		return err
+	}
+	if isEnd(tok, start) {
+		i.SetInt64(0)
+		return nil
+	}
+	switch itok := tok.(type) {
+	case Entity:
+		i.SetUint64(uint64(itok))
+	case CharData:
+		if _, ok := i.SetString(d.number(itok), 10); !ok {
+			return fmt.Errorf("field %s: invalid integer %q", start.Name, itok)
+		}
+	default:
+		return fmt.Errorf("expected a number, got %T", tok)
+	}
+	return d.expectedEnd(start)
+}
+
+// elementField returns the field of the struct type t decoded from the child element
+// name: the field whose wbxml tag has this name, else the field of this name if its tag
+// has no name. With JSONTags, a field without wbxml tag is also found by the name of its
+// json tag.
+func (d *Decoder) elementField(t reflect.Type, name string) (reflect.StructField, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		if tagName, _ := parseTag(t.Field(i).Tag.Get("wbxml")); tagName == name {
+			return t.Field(i), true
+		}
+	}
+	sf, ok := t.FieldByName(name)
+	if tagName, _ := parseTag(sf.Tag.Get("wbxml")); ok && tagName == "" {
+		return sf, true
+	}
+	if !d.JSONTags {
+		return reflect.StructField{}, false
+	}
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		if _, ok := sf.Tag.Lookup("wbxml"); ok {
+			continue
+		}
+		jsonName, _ := parseTag(sf.Tag.Get("json"))
+		if jsonName == name && jsonName != "-" {
+			return sf, true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+// fieldWithOption returns the index of the first field of t tagged with option, or -1.
+func fieldWithOption(t reflect.Type, option string) int {
+	for i := 0; i < t.NumField(); i++ {
+		if _, opts := parseTag(t.Field(i).Tag.Get("wbxml")); opts.Contains(option) {
+			return i
+		}
+	}
+	return -1
+}
+
+// opaqueUint returns the big-endian integer of opaque, which must fit in bits.
+func opaqueUint(opaque Opaque, bits int) (uint64, error) {
+	if len(opaque) == 0 || len(opaque)*8 > bits {
+		return 0, fmt.Errorf("opaque of %d bytes does not fit in %d bits", len(opaque), bits)
+	}
+	var u uint64
+	for _, b := range opaque {
+		u = u<<8 | uint64(b)
+	}
+	return u, nil
+}
+
+// readOpaque returns tok, read to an Opaque if it is an OpaqueReader, for the values
+// decoded from a whole opaque.
+func readOpaque(tok Token) (Token, error) {
+	opaque, ok := tok.(OpaqueReader)
+	if !ok {
+		return tok, nil
+	}
+	data, err := ioutil.ReadAll(opaque)
+	if err != nil {
+		return nil, err
+	}
+	return Opaque(data), nil
+}
+
+// tokenString describes tok in an error message, with its type and its content.
+func tokenString(tok Token) string {
+	switch tok := tok.(type) {
+	case StartElement:
+		return fmt.Sprintf("StartElement %s", tok.Name)
+	case EndElement:
+		return fmt.Sprintf("EndElement %s", tok.Name)
+	case CharData:
+		return fmt.Sprintf("CharData %q", []byte(tok))
+	case Opaque:
+		return fmt.Sprintf("Opaque of %d bytes", len(tok))
+	case Entity:
+		return fmt.Sprintf("Entity 0x%X", uint32(tok))
+	}
+	return fmt.Sprintf("%T", tok)
+}
+
+// isEnd reports whether tok is the end element of start, for an element without content.
+func isEnd(tok Token, start *StartElement) bool {
+	end, ok := tok.(EndElement)
+	return ok && end.Name == start.Name
+}
+
+// number returns the numeric CharData cdata as a string, cleaned by NumberCleaner.
+func (d *Decoder) number(cdata CharData) string {
+	if d.NumberCleaner == nil {
+		return string(cdata)
+	}
+	return d.NumberCleaner(string(cdata))
+}
+
+// decodeBinaryText returns the bytes of a []byte field from its CharData: decoded from
+// hexadecimal with ,hex, from base64 with ,base64, else as-is.
+func decodeBinaryText(cdata CharData, opts tagOptions) ([]byte, error) {
+	switch {
+	case opts.Contains("hex"):
+		data := make([]byte, hex.DecodedLen(len(cdata)))
+		n, err := hex.Decode(data, bytes.TrimSpace(cdata))
+		if err != nil {
+			return nil, fmt.Errorf(",hex expected hexadecimal text: %s", err)
+		}
+		return data[:n], nil
+	case opts.Contains("base64"):
+		data := make([]byte, base64.StdEncoding.DecodedLen(len(cdata)))
+		n, err := base64.StdEncoding.Decode(data, bytes.TrimSpace(cdata))
+		if err != nil {
+			return nil, fmt.Errorf(",base64 expected base64 text: %s", err)
+		}
+		return data[:n], nil
+	}
+	return cdata, nil
+}
+
+// recordSeen adds name to the map[string]bool or []string fld, if not already present.
+func recordSeen(fld reflect.Value, name string) error {
+	switch {
+	case fld.Kind() == reflect.Map && fld.Type().Key().Kind() == reflect.String && fld.Type().Elem().Kind() == reflect.Bool:
+		if fld.IsNil() {
+			fld.Set(reflect.MakeMap(fld.Type()))
+		}
+		fld.SetMapIndex(reflect.ValueOf(name).Convert(fld.Type().Key()), reflect.ValueOf(true).Convert(fld.Type().Elem()))
+	case fld.Kind() == reflect.Slice && fld.Type().Elem().Kind() == reflect.String:
+		for i := 0; i < fld.Len(); i++ {
+			if fld.Index(i).String() == name {
+				return nil
+			}
+		}
+		fld.Set(reflect.Append(fld, reflect.ValueOf(name).Convert(fld.Type().Elem())))
+	default:
+		return fmt.Errorf(",seen expected a map[string]bool or []string, got %s", fld.Type())
+	}
+	return nil
+}
+
+// appendText appends the text of tok to the string or []byte fld, if tok is a CharData,
+// an Entity or an Opaque.
+func appendText(fld reflect.Value, tok Token) error {
+	var text []byte
+	switch tok := tok.(type) {
+	case CharData:
+		text = tok
+	case Entity:
+		text = tok.UTF8()
+	case Opaque:
+		text = tok
+	default:
+		return nil
+	}
+	switch {
+	case fld.Kind() == reflect.String:
+		fld.SetString(fld.String() + string(text))
+	case fld.Kind() == reflect.Slice && fld.Type().Elem().Kind() == reflect.Uint8:
+		fld.SetBytes(append(fld.Bytes(), text...))
+	default:
+		return fmt.Errorf(",chardata expected a string or []byte, got %s", fld.Kind())
+	}
+	return nil
+}
+
+var attrSliceType = reflect.TypeOf([]Attr{})
+
+// decodeAttrs sets the fields of val tagged as attributes from the attributes of start.
+func (d *Decoder) decodeAttrs(val reflect.Value, start *StartElement) error {
+	t := val.Type()
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		_, opts := parseTag(sf.Tag.Get("wbxml"))
+		if opts.Contains("attrs") {
+			if !val.Field(i).CanSet() {
+				// unexported, skipped as the elements are
+				continue
+			}
+			if sf.Type != attrSliceType {
+				return fmt.Errorf("field %s: ,attrs expected a []Attr, got %s", sf.Name, sf.Type)
+			}
+			val.Field(i).Set(reflect.ValueOf(append([]Attr(nil), start.Attr...)))
+			continue
+		}
+		if !opts.Contains("attr") || !val.Field(i).CanSet() {
+			continue
+		}
+		for _, attr := range start.Attr {
+			if attr.Name != fieldName(sf) {
+				continue
+			}
+			if err := d.setAttr(val.Field(i), attr.Value); err != nil {
+				return fmt.Errorf("attribute %s of %s: %s", attr.Name, start.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (d *Decoder) setAttr(fld reflect.Value, value string) error {
+	if values, ok := d.enums[fld.Type()]; ok {
+		v, ok := values[value]
+		if !ok {
+			return fmt.Errorf("unknown %s value %q", fld.Type().Name(), value)
+		}
+		switch fld.Kind() {
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			if v < 0 || fld.OverflowUint(uint64(v)) {
+				return fmt.Errorf("%s value %q of %d overflows %s", fld.Type().Name(), value, v, fld.Kind())
+			}
+			fld.SetUint(uint64(v))
+		default:
+			if fld.OverflowInt(v) {
+				return fmt.Errorf("%s value %q of %d overflows %s", fld.Type().Name(), value, v, fld.Kind())
+			}
+			fld.SetInt(v)
+		}
+		return nil
+	}
+	switch fld.Kind() {
+	case reflect.String:
+		fld.SetString(value)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, err := strconv.ParseInt(value, 10, fld.Type().Bits())
+		if err != nil {
+			return err
+		}
+		fld.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		i, err := strconv.ParseUint(value, 10, fld.Type().Bits())
+		if err != nil {
+			return err
+		}
+		fld.SetUint(i)
+	default:
+		return fmt.Errorf("%s not implemented", fld.Kind())
+	}
+	return nil
+}
+
 func (d *Decoder) expectedEnd(start *StartElement) error {
 	tok, err := d.Token()
 	if err != nil {
@@ -250,6 +1178,26 @@ func (d *Decoder) expectedEnd(start *StartElement) error {
 	return nil
 }
 
+// switchTagPage reads the page index following a SWITCH_PAGE in tag state.
+func (d *Decoder) switchTagPage() {
+	index, err := readByte(d)
+	d.panicErr(err)
+	if _, ok := d.tags[index]; d.Strict && !ok {
+		d.panicErr(fmt.Errorf("SWITCH_PAGE to unknown tag page %d", index))
+	}
+	d.tagPage = index
+}
+
+// switchAttrPage reads the page index following a SWITCH_PAGE in attribute state.
+func (d *Decoder) switchAttrPage() {
+	index, err := readByte(d)
+	d.panicErr(err)
+	if _, ok := d.attrs[index]; d.Strict && !ok {
+		d.panicErr(fmt.Errorf("SWITCH_PAGE to unknown attribute page %d", index))
+	}
+	d.attrPage = index
+}
+
 func (d *Decoder) tagName(code byte) string {
 	name, err := d.tags.Name(d.tagPage, code)
 	if err != nil {
@@ -261,30 +1209,60 @@ func (d *Decoder) tagName(code byte) string {
 func (d *Decoder) attrName(code byte) string {
 	name, err := d.attrs.Name(d.attrPage, code)
 	if err != nil {
-		d.panicErr(err)
+		if !d.LenientAttrs {
+			d.panicErr(err)
+		}
+		d.warn("unknown attribute code 0x%02X in page %d", code, d.attrPage)
+		return fmt.Sprintf("Unknown_0x%02X", code)
 	}
 	return name
 }
 
+// run decodes the header and the root element of the stream, and returns once the end
+// of the root element is sent.
 func (d *Decoder) run() {
-	defer func() {
-		if r := recover(); r != nil {
-			if err, ok := r.(error); ok {
-				d.err = err
-				close(d.tokChan)
-				return
-			}
-			panic(r)
-		}
-	}()
+	defer d.stop()
 
 	h, err := d.readHeader()
 	d.panicErr(err)
 	d.Header = h
+	d.panicErr(d.setCharset(h.Charset))
 	d.body()
+}
+
+// trailer decodes the processing instructions following the root element, up to the
+// end of the stream.
+func (d *Decoder) trailer() {
+	defer d.stop()
+
+	for {
+		b, err := readByte(d)
+		d.panicErr(err)
+		if b != gloPi {
+			// trailing bytes are left unread, unless strict mode requires the end of the stream
+			if d.Strict {
+				d.panicErr(fmt.Errorf("unexpected byte 0x%02X after the root element", b))
+			}
+			break
+		}
+		d.procInst()
+	}
+	d.err = io.EOF
 	close(d.tokChan)
 }
 
+// stop recovers the error a decoding goroutine panicked with, and ends the stream on it.
+func (d *Decoder) stop() {
+	if r := recover(); r != nil {
+		if err, ok := r.(error); ok {
+			d.err = err
+			close(d.tokChan)
+			return
+		}
+		panic(r)
+	}
+}
+
 // readHeader reads the wbxml header.
 func (d *Decoder) readHeader() (Header, error) {
 	var h Header
@@ -294,6 +1272,15 @@ func (d *Decoder) readHeader() (Header, error) {
 	if err != nil {
 		return h, err
 	}
+	for d.SkipLeading && h.Version > maxVersion {
+		h.Version, err = readByte(d)
+		if err != nil {
+			return h, err
+		}
+	}
+	if h.Version > maxVersion {
+		return h, fmt.Errorf("leading byte 0x%02X is not a known WBXML version", h.Version)
+	}
 
 	h.PublicID, err = mbUint32(d)
 	if err != nil {
@@ -313,11 +1300,10 @@ func (d *Decoder) readHeader() (Header, error) {
 		return h, err
 	}
 	buf := make([]byte, length)
-	n, err := d.r.Read(buf)
+	_, err = d.read(buf)
 	if err != nil {
 		return h, err
 	}
-	d.offset += n
 	h.StringTable = buf
 	return h, nil
 }
@@ -332,47 +1318,88 @@ func (d *Decoder) body() {
 		if b != gloPi {
 			break
 		}
-		d.piStar()
+		d.procInst()
 	}
 
-	d.element(b)
-
-	for {
+	// the root element may be preceded by a SWITCH_PAGE
+	for b == gloSwitchPage {
+		d.element(b)
 		b, err = readByte(d)
 		d.panicErr(err)
-		if b != gloPi {
-			break
-		}
-		d.piStar()
 	}
+	d.element(b)
 }
 
-func (d *Decoder) piStar() {
+// procInst emits the processing instruction following a PI, whose attribute gives the
+// target and its value the instruction.
+func (d *Decoder) procInst() {
+	b, err := readByte(d)
+	d.panicErr(err)
+	for b == gloSwitchPage {
+		d.switchAttrPage()
+		b, err = readByte(d)
+		d.panicErr(err)
+	}
+	var target string
+	switch {
+	case b == gloLiteral:
+		index, err := mbUint32(d)
+		d.panicErr(err)
+		name, err := d.GetString(index)
+		d.panicErr(err)
+		target = string(name)
+	case b == gloEnd || b >= 128:
+		d.panicErr(fmt.Errorf("expected the target of a processing instruction, got 0x%02X", b))
+	default:
+		target = d.attrName(b)
+	}
+	inst, b := d.readAttrValue()
+	if b != gloEnd {
+		d.panicErr(fmt.Errorf("expected the end of processing instruction %s, got 0x%02X", target, b))
+	}
+	d.emit(ProcInst{Target: target, Inst: []byte(inst)})
 }
 
 func (d *Decoder) element(b byte) {
 	switch b {
 	case gloSwitchPage:
-		index, err := readByte(d)
-		d.panicErr(err)
-		d.tagPage = index
+		d.switchTagPage()
+		if d.EmitSwitchPage {
+			d.emit(SwitchPage(d.tagPage))
+		}
 	case gloLiteral, gloLiteralA, gloLiteralC, gloLiteralAC:
-		panic(fmt.Errorf("literal tag not implemented"))
+		start := d.offset - 1
+		index, err := mbUint32(d)
+		d.panicErr(err)
+		name, err := d.GetString(index)
+		d.panicErr(err)
+		d.tagElement(Tag(b), string(name), start)
 	default:
 		tag := Tag(b)
-		tagName := d.tagName(tag.ID())
-		tok := StartElement{Name: tagName}
-		if tag.Attr() {
-			d.attributes(&tok)
-		}
-		tok.Content = tag.Content()
-		tok.Offset = d.offset - 1
-		d.tokChan <- tok
-		if tag.Content() {
-			d.content()
-		}
-		d.tokChan <- EndElement{Name: tagName, Offset: d.offset}
+		d.tagElement(tag, d.tagName(tag.ID()), d.offset-1)
+	}
+}
+
+// tagElement emits the element of tag, named tagName, whose tag starts at offset start.
+func (d *Decoder) tagElement(tag Tag, tagName string, start int) {
+	d.open++
+	tok := StartElement{Name: tagName, StartOffset: start}
+	if tag.Attr() {
+		d.attributes(&tok)
+	}
+	tok.Content = tag.Content()
+	tok.Offset = d.offset - 1
+	tok.EndOffset = d.offset
+	d.emit(tok)
+	end := EndElement{Name: tagName, StartOffset: d.offset}
+	if tag.Content() {
+		d.content(tagName)
+		end.StartOffset = d.offset - 1
 	}
+	end.Offset, end.EndOffset = d.offset, d.offset
+	d.open--
+	d.rootEnd = d.open == 0
+	d.emit(end)
 }
 
 func (d *Decoder) attributes(elt *StartElement) {
@@ -382,9 +1409,9 @@ func (d *Decoder) attributes(elt *StartElement) {
 	for {
 		switch b {
 		case gloSwitchPage:
-			index, err := readByte(d)
+			d.switchAttrPage()
+			b, err = readByte(d)
 			d.panicErr(err)
-			d.attrPage = index
 		case gloLiteral:
 			var attr Attr
 			index, err := mbUint32(d)
@@ -408,23 +1435,49 @@ func (d *Decoder) attributes(elt *StartElement) {
 	}
 }
 
+// maxAttrValueTokens bounds the number of tokens of an attribute value, so that a
+// hostile stream cannot make readAttrValue grow a value forever.
+const maxAttrValueTokens = 1 << 16
+
+// readAttrValue reads the value of an attribute, and returns it with the byte following
+// it, either END or the start of the next attribute.
 func (d *Decoder) readAttrValue() (string, byte) {
 	var cdata CharData
-	for {
+	for i := 0; ; i++ {
+		if i == maxAttrValueTokens {
+			d.panicErr(fmt.Errorf("attribute value of more than %d tokens", maxAttrValueTokens))
+		}
 		b, err := readByte(d)
+		if err == io.EOF {
+			err = fmt.Errorf("unterminated attribute value")
+		}
 		d.panicErr(err)
 
 		switch b {
 		case gloSwitchPage:
-			index, err := readByte(d)
-			d.panicErr(err)
-			d.attrPage = index
-		case gloStrI, gloStrT, gloEntity:
+			d.switchAttrPage()
+		case gloStrI, gloStrT:
 			d.charData(&cdata, b)
-		case gloExt0, gloExt1, gloExt2,
-			gloExtI0, gloExtI1, gloExtI2,
-			gloExtT0, gloExtT1, gloExtT2:
-			panic(fmt.Errorf("extension token unimplemented (token %d)", b))
+		case gloEntity:
+			entity := d.readEntity()
+			d.warn("entity 0x%X flattened into an attribute value", uint32(entity))
+			cdata = append(cdata, entity.UTF8()...)
+		case gloExtT0, gloExtT1, gloExtT2:
+			index, err := mbUint32(d)
+			d.panicErr(err)
+			str, err := d.ExtensionString(Extension{ID: b - gloExtT0, Kind: ExtInteger, Index: index})
+			d.panicErr(err)
+			d.warn("EXT_T_%d extension flattened into an attribute value", b-gloExtT0)
+			cdata = append(cdata, str...)
+		case gloExtI0, gloExtI1, gloExtI2:
+			str, err := readString(d)
+			d.panicErr(err)
+			str, err = d.convert(str)
+			d.panicErr(err)
+			d.warn("EXT_I_%d extension flattened into an attribute value", b-gloExtI0)
+			cdata = append(cdata, str...)
+		case gloExt0, gloExt1, gloExt2:
+			d.panicErr(fmt.Errorf("EXT_%d extension in an attribute value", b-gloExt0))
 		case gloEnd:
 			return string(cdata), b
 		default:
@@ -437,69 +1490,171 @@ func (d *Decoder) readAttrValue() (string, byte) {
 	}
 }
 
-func (d *Decoder) content() {
+func (d *Decoder) content(name string) {
 	// content() accumulate adjacent CharData in a unique instance until END or ELEMENT is
 	// encountered
 
 	var cdata CharData
+	var opaque Opaque // opaque that may be folded in the following CharData
 	for {
 		b, err := readByte(d)
 		d.panicErr(err)
 
 		switch b {
 		case gloStrI, gloStrT, gloEntity:
+			if opaque != nil {
+				cdata, opaque = CharData(opaque), nil
+			}
 			d.charData(&cdata, b)
 		case gloOpaque:
+			if d.FoldOpaque {
+				d.foldOpaque(&cdata, &opaque)
+				break
+			}
 			d.sendCharData(&cdata)
 			length, err := mbUint32(d)
 			d.panicErr(err)
+			if d.StreamOpaque {
+				d.streamOpaque(length)
+				break
+			}
 			data, err := readSlice(d, length)
 			d.panicErr(err)
-			d.tokChan <- Opaque(data)
-		case gloExt0, gloExt1, gloExt2,
-			gloExtI0, gloExtI1, gloExtI2,
-			gloExtT0, gloExtT1, gloExtT2:
-			panic(fmt.Errorf("extension token unimplemented (token %d)", b))
+			value := Opaque(data)
+			if handler, ok := d.opaques[name]; ok {
+				value, err = handler(value)
+				d.panicErr(err)
+			}
+			d.emit(value)
+		case gloPi:
+			d.sendOpaque(&opaque)
+			d.sendCharData(&cdata)
+			d.procInst()
+		case gloExtI0, gloExtI1, gloExtI2:
+			d.sendOpaque(&opaque)
+			d.sendCharData(&cdata)
+			str, err := readString(d)
+			d.panicErr(err)
+			str, err = d.convert(str)
+			d.panicErr(err)
+			d.emit(Extension{ID: b - gloExtI0, Kind: ExtString, Data: str})
+		case gloExtT0, gloExtT1, gloExtT2:
+			d.sendOpaque(&opaque)
+			d.sendCharData(&cdata)
+			index, err := mbUint32(d)
+			d.panicErr(err)
+			d.emit(Extension{ID: b - gloExtT0, Kind: ExtInteger, Index: index})
+		case gloExt0, gloExt1, gloExt2:
+			d.sendOpaque(&opaque)
+			d.sendCharData(&cdata)
+			d.emit(Extension{ID: b - gloExt0, Kind: ExtByte})
 		case gloEnd:
+			d.sendOpaque(&opaque)
 			d.sendCharData(&cdata)
 			return
 		default:
+			d.sendOpaque(&opaque)
 			d.sendCharData(&cdata)
 			d.element(b)
 		}
 	}
 }
 
+// streamOpaque emits an OpaqueReader over the next length bytes of the stream. Once the
+// next token is asked for, the bytes left unread by the consumer are skipped.
+func (d *Decoder) streamOpaque(length uint32) {
+	r := &io.LimitedReader{R: readerFunc(d.read), N: int64(length)}
+	d.emit(OpaqueReader{r})
+	_, err := io.Copy(ioutil.Discard, r)
+	d.panicErr(err)
+	if r.N > 0 {
+		d.panicErr(fmt.Errorf("expected %d bytes, got %d", length, int64(length)-r.N))
+	}
+}
+
+// foldOpaque reads an opaque and appends it to cdata if some text precedes it, else
+// keeps it in opaque in case some text follows.
+func (d *Decoder) foldOpaque(cdata *CharData, opaque *Opaque) {
+	length, err := mbUint32(d)
+	d.panicErr(err)
+	data, err := readSlice(d, length)
+	d.panicErr(err)
+	if *cdata != nil {
+		*cdata = append(*cdata, data...)
+		return
+	}
+	d.sendOpaque(opaque)
+	*opaque = data
+}
+
+func (d *Decoder) sendOpaque(opaque *Opaque) {
+	if *opaque != nil {
+		d.emit(*opaque)
+		*opaque = nil
+	}
+}
+
 func (d *Decoder) sendCharData(cdata *CharData) {
 	if *cdata != nil {
-		d.tokChan <- *cdata
+		d.emit(*cdata)
 		*cdata = nil
 	}
 }
 
+// appendString appends str to cdata. For a decoder created by NewBytesDecoder, a first
+// string is not copied: its capacity is limited, so that appending the following strings
+// reallocates cdata instead of overwriting the source.
+func (d *Decoder) appendString(cdata *CharData, str []byte) {
+	if len(*cdata) == 0 && d.src != nil && len(str) > 0 {
+		*cdata = str[:len(str):len(str)]
+		return
+	}
+	*cdata = append(*cdata, str...)
+}
+
+// readEntity reads the code point following an ENTITY.
+func (d *Decoder) readEntity() Entity {
+	entcode, err := mbUint32(d)
+	d.panicErr(err)
+	if d.Strict && !utf8.ValidRune(rune(entcode)) {
+		d.panicErr(fmt.Errorf("entity 0x%X is not a valid code point", entcode))
+	}
+	return Entity(entcode)
+}
+
+// warn records a non fatal issue found at the current position.
+func (d *Decoder) warn(format string, args ...interface{}) {
+	d.Warnings = append(d.Warnings, Warning{Msg: fmt.Sprintf(format, args...), Offset: d.offset})
+}
+
+// charData appends the string or entity following b to cdata. A string, even empty,
+// makes cdata non-nil, so that it is sent as a CharData, while a leading entity is sent
+// as an Entity.
 func (d *Decoder) charData(cdata *CharData, b byte) {
-	if cdata == nil {
+	if *cdata == nil && b != gloEntity {
 		*cdata = make([]byte, 0)
 	}
 	switch b {
 	case gloStrI:
 		str, err := readString(d)
 		d.panicErr(err)
-		*cdata = append(*cdata, str...)
+		str, err = d.convert(str)
+		d.panicErr(err)
+		d.appendString(cdata, str)
 	case gloStrT:
 		index, err := mbUint32(d)
 		d.panicErr(err)
 		str, err := d.GetString(index)
 		d.panicErr(err)
-		*cdata = append(*cdata, str...)
-	case gloEntity:
-		entcode, err := mbUint32(d)
+		str, err = d.convertTable(str)
 		d.panicErr(err)
-		entity := Entity(entcode)
+		d.appendString(cdata, str)
+	case gloEntity:
+		entity := d.readEntity()
 		if len(*cdata) > 0 {
 			*cdata = append(*cdata, entity.UTF8()...)
 		} else {
-			d.tokChan <- entity
+			d.emit(entity)
 		}
 	default:
 		d.panicErr(fmt.Errorf("Unknown char data tag %d", b))
@@ -0,0 +1,75 @@
+package wbxml
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+)
+
+// TokenDiff is a difference between the tokens of two WBXML documents.
+type TokenDiff struct {
+	Index   int   // index of the tokens in their document
+	A       Token // token of the first document, nil if it has less tokens
+	B       Token // token of the second document, nil if it has less tokens
+	OffsetA int   // position of the decoder of the first document after reading A
+	OffsetB int   // position of the decoder of the second document after reading B
+}
+
+// Diff decodes the WBXML documents a and b and compares their tokens one by one,
+// ignoring their offsets. It returns the first difference, where the documents diverge,
+// or nil if they have the same tokens. The following tokens are not compared, as a token
+// inserted or removed in one document shifts all of them.
+func Diff(a, b []byte, tags, attrs CodeSpace) ([]TokenDiff, error) {
+	toksA, offsA, err := decodeWithOffsets(a, tags, attrs)
+	if err != nil {
+		return nil, err
+	}
+	toksB, offsB, err := decodeWithOffsets(b, tags, attrs)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := 0; i < len(toksA) || i < len(toksB); i++ {
+		diff := TokenDiff{Index: i}
+		if i < len(toksA) {
+			diff.A, diff.OffsetA = toksA[i], offsA[i]
+		}
+		if i < len(toksB) {
+			diff.B, diff.OffsetB = toksB[i], offsB[i]
+		}
+		if !reflect.DeepEqual(withoutOffset(diff.A), withoutOffset(diff.B)) {
+			return []TokenDiff{diff}, nil
+		}
+	}
+	return nil, nil
+}
+
+// decodeWithOffsets returns the tokens of doc, and the offset of the decoder after each.
+func decodeWithOffsets(doc []byte, tags, attrs CodeSpace) ([]Token, []int, error) {
+	d := NewDecoder(bytes.NewReader(doc), tags, attrs)
+	var toks []Token
+	var offsets []int
+	for {
+		tok, err := d.Token()
+		if err == io.EOF {
+			return toks, offsets, nil
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		toks = append(toks, tok)
+		offsets = append(offsets, d.offset)
+	}
+}
+
+func withoutOffset(tok Token) Token {
+	switch t := tok.(type) {
+	case StartElement:
+		t.Offset, t.StartOffset, t.EndOffset = 0, 0, 0
+		return t
+	case EndElement:
+		t.Offset, t.StartOffset, t.EndOffset = 0, 0, 0
+		return t
+	}
+	return tok
+}
@@ -0,0 +1,57 @@
+package wbxml
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiff(t *testing.T) {
+	space := tagSpaceExamples[1]
+
+	diffs, err := Diff(decodingExamples[1], decodingExamples[1], space.tags, space.attrs)
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	assert.Equal(t, 0, len(diffs))
+
+	// " Enter name: " is referenced from the string table
+	other := bytes.Replace(decodingExamples[1], []byte(" Enter name: "), []byte(" Enter NAME: "), 1)
+	diffs, err = Diff(decodingExamples[1], other, space.tags, space.attrs)
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	expected := []TokenDiff{
+		{
+			Index:   4,
+			A:       CharData(" Enter name: "),
+			B:       CharData(" Enter NAME: "),
+			OffsetA: 47,
+			OffsetB: 47,
+		},
+	}
+	assert.Equal(t, expected, diffs)
+}
+
+func TestDiffInsertedToken(t *testing.T) {
+	space := tagSpaceExamples[0]
+	// XYZ with an empty CARD, and with an empty BR before it
+	a := []byte{0x01, 0x01, 0x6A, 0x00, 0x47, 0x06, 0x01}
+	b := []byte{0x01, 0x01, 0x6A, 0x00, 0x47, 0x05, 0x06, 0x01}
+
+	diffs, err := Diff(a, b, space.tags, space.attrs)
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	expected := []TokenDiff{
+		{
+			Index:   1,
+			A:       StartElement{Name: "CARD", Offset: 5, StartOffset: 5, EndOffset: 6},
+			B:       StartElement{Name: "BR", Offset: 5, StartOffset: 5, EndOffset: 6},
+			OffsetA: 6,
+			OffsetB: 6,
+		},
+	}
+	assert.Equal(t, expected, diffs)
+}
@@ -2,9 +2,16 @@ package wbxml
 
 import (
 	"bytes"
+	"encoding/base64"
+	"encoding/hex"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 )
 
 // Marshaler is an interface implemented by a type that wish to control how it is encoded
@@ -15,6 +22,15 @@ type Marshaler interface {
 	MarshalWBXML(e *Encoder, st StartElement) error
 }
 
+// TokenMarshaler is an interface implemented by a type that encodes to a list of tokens,
+// without writing them to the Encoder itself as a Marshaler does.
+//
+// MarshalWBXMLTokens returns the tokens of the element started by st, which are encoded
+// in turn, from its StartElement to its EndElement.
+type TokenMarshaler interface {
+	MarshalWBXMLTokens(st StartElement) ([]Token, error)
+}
+
 // Encoder encodes values to WBXML.
 type Encoder struct {
 	w io.Writer
@@ -28,7 +44,33 @@ type Encoder struct {
 	tokChan   chan Token
 	ignoreEnd []string
 	err       error
+	strCount  map[string]int
+	strOrder  []string
+	literals  map[string]bool // names written as LITERAL while scanning for EncodeDocument
+	deferred  io.Writer       // writer of the document while the header is deferred
+	hasHeader bool
 	Header    Header
+
+	// AutoHeader makes the encoder write a default header, WBXML 1.3 with an unknown
+	// public identifier, UTF-8 charset and no string table, before the first token if
+	// neither EncodeHeader nor DeferHeader was called.
+	AutoHeader bool
+
+	// ShouldTable, if set, decides whether the string s is written as a reference to the
+	// string table, inTable reporting whether s is found at index in the table. Otherwise
+	// a string is referenced whenever it is in the table. When the header is deferred by
+	// DeferHeader, a string not in the table is added to it if ShouldTable returns true.
+	ShouldTable func(s []byte, index uint32, inTable bool) bool
+
+	// LiteralTags makes the encoder write a tag missing from the CodeSpace as a LITERAL
+	// referencing its name in the string table, added to it while the header is deferred.
+	// Otherwise such a tag is an error.
+	LiteralTags bool
+
+	// UseStringer makes the encoder write a value implementing fmt.Stringer, but not
+	// Marshaler, as the CharData returned by its String method. A String method with a
+	// pointer receiver is only used for a value reached through a pointer.
+	UseStringer bool
 }
 
 // NewEncoder instantiates an Encoder, writting WBXML to w.
@@ -45,13 +87,15 @@ func NewEncoder(w io.Writer, tags CodeSpace, attrs CodeSpace) *Encoder {
 }
 
 // GetIndex returns the byte position of str in the string table. It returns 0 and false
-// if the string is not found.
+// if the string is not found. As a reference may point in the middle of a string, str
+// is found if it is a string of the table or the end of one.
 func (e *Encoder) GetIndex(str []byte) (uint32, bool) {
 	start := 0
 	for end, b := range e.Header.StringTable {
 		if b == 0 {
-			if bytes.Equal(str, e.Header.StringTable[start:end]) {
-				return uint32(start), true
+			entry := e.Header.StringTable[start:end]
+			if bytes.Equal(str, entry) || (len(str) > 0 && bytes.HasSuffix(entry, str)) {
+				return uint32(end - len(str)), true
 			}
 			start = end + 1
 		}
@@ -60,9 +104,24 @@ func (e *Encoder) GetIndex(str []byte) (uint32, bool) {
 }
 
 // EncodeHeader encodes the WBXML header.
-// It sets the string table used by Encode and EncodeElement.
+// It sets the string table used by Encode and EncodeElement. It starts a new document,
+// so that several documents can be written one after the other to the same stream.
 func (e *Encoder) EncodeHeader(h Header) error {
+	e.reset()
+	return e.writeHeader(h)
+}
+
+// reset resets the state of the encoder tied to the previous document, so that several
+// documents can be encoded one after the other.
+func (e *Encoder) reset() {
+	e.tagPage = 0
+	e.attrPage = 0
+	e.ignoreEnd = e.ignoreEnd[:0]
+}
+
+func (e *Encoder) writeHeader(h Header) error {
 	e.Header = h
+	e.hasHeader = true
 
 	err := writeByte(e, h.Version)
 	if err != nil {
@@ -93,9 +152,102 @@ func (e *Encoder) EncodeHeader(h Header) error {
 	return writeSlice(e, h.StringTable)
 }
 
+// DeferHeader sets the header h, but delays writing it until Flush, so that strings can
+// be added to its string table with AddString while encoding the body. The body is kept
+// in memory until then, and the length of the string table written by Flush always
+// matches the final table.
+func (e *Encoder) DeferHeader(h Header) {
+	e.reset()
+	e.Header = h
+	e.hasHeader = true
+	if e.deferred == nil {
+		e.deferred = e.w
+		e.w = bytes.NewBuffer(nil)
+	}
+}
+
+// AddString adds str to the string table, if it is not already in it, and returns its
+// index. As the string table is written by the header, it is mostly used with DeferHeader.
+func (e *Encoder) AddString(str []byte) uint32 {
+	if index, ok := e.GetIndex(str); ok {
+		return index
+	}
+	index := uint32(len(e.Header.StringTable))
+	e.Header.StringTable = append(append(e.Header.StringTable, str...), 0)
+	return index
+}
+
+// Flush writes the header set by DeferHeader, followed by the body encoded since then.
+// It does nothing if the header is not deferred.
+func (e *Encoder) Flush() error {
+	if e.deferred == nil {
+		return nil
+	}
+	body := e.w.(*bytes.Buffer)
+	e.w, e.deferred = e.deferred, nil
+	e.offset = 0
+	err := e.writeHeader(e.Header)
+	if err != nil {
+		return err
+	}
+	return writeSlice(e, body.Bytes())
+}
+
+// Close writes the document buffered by DeferHeader, if any, and returns the first write
+// error met by the encoder, even one already returned to and ignored by the caller.
+func (e *Encoder) Close() error {
+	err := e.Flush()
+	if e.err != nil {
+		return e.err
+	}
+	return err
+}
+
+// setErr records err as the first write error of the encoder, and returns it.
+func (e *Encoder) setErr(err error) error {
+	if err != nil && e.err == nil {
+		e.err = err
+	}
+	return err
+}
+
+// EncodeDocument encodes the header and the value v as the root element of a WBXML
+// document. The string table is built from the strings occurring more than once in the
+// document, which are then written as string table references, and from the names written
+// as LITERAL with LiteralTags. With ShouldTable, only the strings it accepts are tabled.
+// Version, PublicID and Charset of the header are taken from e.Header.
+func (e *Encoder) EncodeDocument(v interface{}, root StartElement) error {
+	scan := NewEncoder(ioutil.Discard, e.tags, e.attrs)
+	scan.ShouldTable = e.ShouldTable
+	scan.LiteralTags = e.LiteralTags
+	scan.UseStringer = e.UseStringer
+	scan.strCount = make(map[string]int)
+	scan.literals = make(map[string]bool)
+	err := scan.EncodeElement(v, root)
+	if err != nil {
+		return err
+	}
+
+	h := e.Header
+	h.StringTable = nil
+	for _, str := range scan.strOrder {
+		if scan.strCount[str] > 1 || scan.literals[str] {
+			h.StringTable = append(append(h.StringTable, str...), 0)
+		}
+	}
+	err = e.EncodeHeader(h)
+	if err != nil {
+		return err
+	}
+	return e.EncodeElement(v, root)
+}
+
 // EncodeToken encode a WBXML token, and may return an error if the write fails.
 // It is mostly used by types implementing Marshaler.
 func (e *Encoder) EncodeToken(tok Token) error {
+	if err := e.autoHeader(); err != nil {
+		return err
+	}
 	switch tok := tok.(type) {
 	case StartElement:
 		return e.encodeTag(tok)
@@ -107,15 +259,50 @@ func (e *Encoder) EncodeToken(tok Token) error {
 		return e.writeString(tok)
 	case Opaque:
 		return writeOpaque(e, tok)
+	case OpaqueReader:
+		return writeOpaqueReader(e, tok)
 	case Entity:
 		return e.writeEntity(tok)
+	case Extension:
+		return e.writeExtension(tok)
+	case SwitchPage:
+		e.tagPage = byte(tok)
+		err := writeByte(e, gloSwitchPage)
+		if err != nil {
+			return err
+		}
+		return writeByte(e, byte(tok))
 	default:
 		return fmt.Errorf("unknown token %T", tok)
 	}
 }
 
+// WriteRaw writes raw, an already encoded WBXML fragment such as a cached element, as-is
+// to the stream. The code pages are not tracked in raw, so the fragment must end on the
+// code pages it started on, and string table references in raw must point to the string
+// table of the document.
+func (e *Encoder) WriteRaw(raw []byte) error {
+	if err := e.autoHeader(); err != nil {
+		return err
+	}
+	return writeSlice(e, raw)
+}
+
+// autoHeader writes the default header if AutoHeader is set and no header was given yet.
+func (e *Encoder) autoHeader() error {
+	if !e.AutoHeader || e.hasHeader {
+		return nil
+	}
+	return e.EncodeHeader(Header{Version: maxVersion, PublicID: 1, Charset: 106})
+}
+
 // EncodeElement encodes the value v to a WBXML element. start is used to define
 // the name of the WBXML element.
+//
+// A nil pointer or interface, and false, write nothing. An empty string, slice or map,
+// and a zero number, write an element, except for a struct field tagged ,omitempty,
+// which is then not written at all. A map must have string keys, and writes a child
+// element named by each key, in the order of the keys.
 func (e *Encoder) EncodeElement(v interface{}, start StartElement) error {
 	val := reflect.ValueOf(v)
 
@@ -127,8 +314,8 @@ func (e *Encoder) EncodeElement(v interface{}, start StartElement) error {
 		if val.IsNil() {
 			return nil
 		}
-		if marsh, ok := val.Interface().(Marshaler); ok {
-			return marsh.MarshalWBXML(e, start)
+		if ok, err := e.marshalCustom(val.Interface(), start); ok {
+			return err
 		}
 		val = val.Elem()
 	}
@@ -136,32 +323,91 @@ func (e *Encoder) EncodeElement(v interface{}, start StartElement) error {
 		if val.IsNil() {
 			return nil
 		}
-		if marsh, ok := val.Interface().(Marshaler); ok {
-			return marsh.MarshalWBXML(e, start)
+		if ok, err := e.marshalCustom(val.Interface(), start); ok {
+			return err
 		}
 		val = val.Elem()
 	}
 	if !val.IsValid() {
 		return nil
 	}
-	if marsh, ok := val.Interface().(Marshaler); ok {
-		return marsh.MarshalWBXML(e, start)
+	if ok, err := e.marshalCustom(val.Interface(), start); ok {
+		return err
+	}
+	if e.UseStringer {
+		str, ok := val.Interface().(fmt.Stringer)
+		if !ok && val.CanAddr() {
+			// String may have a pointer receiver
+			str, ok = val.Addr().Interface().(fmt.Stringer)
+		}
+		if ok {
+			return e.marshalValue(reflect.ValueOf(str.String()), start)
+		}
 	}
 	return e.marshalValue(val, start)
 }
 
+// marshalCustom encodes v with its MarshalWBXML or MarshalWBXMLTokens method, and
+// reports whether v implements Marshaler or TokenMarshaler.
+func (e *Encoder) marshalCustom(v interface{}, start StartElement) (bool, error) {
+	switch marsh := v.(type) {
+	case Marshaler:
+		return true, marsh.MarshalWBXML(e, start)
+	case TokenMarshaler:
+		toks, err := marsh.MarshalWBXMLTokens(start)
+		if err != nil {
+			return true, err
+		}
+		for _, tok := range toks {
+			if err := e.EncodeToken(tok); err != nil {
+				return true, err
+			}
+		}
+		return true, nil
+	}
+	return false, nil
+}
+
 func (e *Encoder) marshalValue(val reflect.Value, start StartElement) error {
 	kind := val.Kind()
 	typ := val.Type()
 
 	switch kind {
 	case reflect.Struct:
+		if typ == timeType {
+			// its fields are unexported, so it would be written as an empty element
+			return fmt.Errorf("time.Time not supported, implement Marshaler or set UseStringer")
+		}
 		start.Content = false
+		start.Attr = start.Attr[:len(start.Attr):len(start.Attr)]
 		for i := 0; i < val.NumField(); i++ {
 			fld := val.Field(i)
-			if fld.IsValid() {
+			_, opts := parseTag(typ.Field(i).Tag.Get("wbxml"))
+			switch {
+			case opts.Contains("attrs"):
+				if !fld.CanInterface() {
+					// unexported, skipped as the elements are
+					break
+				}
+				attrs, ok := fld.Interface().([]Attr)
+				if !ok {
+					return fmt.Errorf("%s.%s: ,attrs expected a []Attr, got %s", typ.Name(), typ.Field(i).Name, fld.Type())
+				}
+				start.Attr = append(start.Attr, attrs...)
+			case opts.Contains("attr"):
+				attr, err := fieldAttr(fieldName(typ.Field(i)), fld)
+				if err != nil {
+					return fmt.Errorf("%s.%s: %s", typ.Name(), typ.Field(i).Name, err)
+				}
+				start.Attr = append(start.Attr, attr)
+			case opts.Contains("chardata"):
+				start.Content = start.Content || !isEmptyText(fld)
+			case opts.Contains("seen"), opts.Contains("name"):
+				// only filled when decoding
+			case e.omitField(fieldName(typ.Field(i)), fld, opts):
+				// no code for this field, or empty and omitted
+			case !isSkipped(fld):
 				start.Content = true
-				break
 			}
 		}
 		err := e.EncodeToken(start)
@@ -170,8 +416,26 @@ func (e *Encoder) marshalValue(val reflect.Value, start StartElement) error {
 		}
 		for i := 0; i < val.NumField() && start.Content; i++ {
 			fld := val.Field(i)
-			if fld.IsValid() && fld.CanInterface() {
-				err := e.EncodeElement(fld.Interface(), StartElement{Name: typ.Field(i).Name})
+			_, opts := parseTag(typ.Field(i).Tag.Get("wbxml"))
+			if opts.Contains("chardata") {
+				err := e.encodeText(fld)
+				if err != nil {
+					return fmt.Errorf("%s.%s: %s", typ.Name(), typ.Field(i).Name, err)
+				}
+				continue
+			}
+			if opts.isElement() && fld.IsValid() && fld.CanInterface() && !e.omitField(fieldName(typ.Field(i)), fld, opts) {
+				value := fld.Interface()
+				if _, ok := value.(fmt.Stringer); !ok && e.UseStringer && fld.CanAddr() {
+					// keep a String method with a pointer receiver reachable
+					if _, ok := fld.Addr().Interface().(fmt.Stringer); ok {
+						value = fld.Addr().Interface()
+					}
+				}
+				if text, ok := fieldText(fld, opts); ok {
+					value = text
+				}
+				err := e.EncodeElement(value, StartElement{Name: fieldName(typ.Field(i))})
 				if err != nil {
 					return fmt.Errorf("%s.%s: %s", typ.Name(), typ.Field(i).Name, err)
 				}
@@ -185,13 +449,41 @@ func (e *Encoder) marshalValue(val reflect.Value, start StartElement) error {
 			return err
 		}
 		if start.Content {
-			if typ.Elem().Kind() == reflect.Uint8 {
+			elem := typ.Elem()
+			switch {
+			case elem.Kind() == reflect.Uint8:
 				err := e.EncodeToken(Opaque(val.Bytes()))
 				if err != nil {
 					return err
 				}
-			} else {
-				return fmt.Errorf("slice other than []byte are not supported")
+			case elem.Kind() == reflect.Slice && elem.Elem().Kind() == reflect.Uint8:
+				// [][]byte, one opaque per chunk
+				for i := 0; i < val.Len(); i++ {
+					err := e.EncodeToken(Opaque(val.Index(i).Bytes()))
+					if err != nil {
+						return err
+					}
+				}
+			default:
+				return fmt.Errorf("slice other than []byte and [][]byte are not supported")
+			}
+		}
+		return e.EncodeToken(EndElement{Name: start.Name})
+	case reflect.Map:
+		if typ.Key().Kind() != reflect.String {
+			return fmt.Errorf("map expected string keys, got %s", typ.Key())
+		}
+		start.Content = val.Len() > 0
+		err := e.EncodeToken(start)
+		if err != nil {
+			return err
+		}
+		keys := val.MapKeys()
+		sort.Slice(keys, func(i, j int) bool { return keys[i].String() < keys[j].String() })
+		for _, key := range keys {
+			err := e.EncodeElement(val.MapIndex(key).Interface(), StartElement{Name: key.String()})
+			if err != nil {
+				return fmt.Errorf("%s[%s]: %s", start.Name, key.String(), err)
 			}
 		}
 		return e.EncodeToken(EndElement{Name: start.Name})
@@ -248,12 +540,190 @@ func (e *Encoder) marshalValue(val reflect.Value, start StartElement) error {
 	return nil
 }
 
+var timeType = reflect.TypeOf(time.Time{})
+
+// fieldText returns the text of the element of a slice field written as one CharData:
+// a []byte as hexadecimal if tagged ,hex or as base64 if tagged ,base64, and a []string
+// joined on sep if tagged ,join=sep. It returns false if fld is written as usual.
+func fieldText(fld reflect.Value, opts tagOptions) (string, bool) {
+	if fld.Kind() != reflect.Slice {
+		return "", false
+	}
+	switch fld.Type().Elem().Kind() {
+	case reflect.Uint8:
+		switch {
+		case opts.Contains("hex"):
+			return hex.EncodeToString(fld.Bytes()), true
+		case opts.Contains("base64"):
+			return base64.StdEncoding.EncodeToString(fld.Bytes()), true
+		}
+	case reflect.String:
+		if sep, ok := opts.Value("join"); ok {
+			parts := make([]string, fld.Len())
+			for i := range parts {
+				parts[i] = fld.Index(i).String()
+			}
+			return strings.Join(parts, sep), true
+		}
+	}
+	return "", false
+}
+
+// fieldAttr returns the attribute name encoding the value of the struct field fld.
+func fieldAttr(name string, fld reflect.Value) (Attr, error) {
+	switch fld.Kind() {
+	case reflect.String:
+		return Attr{Name: name, Value: fld.String()}, nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return Attr{Name: name, Value: strconv.FormatInt(fld.Int(), 10)}, nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return Attr{Name: name, Value: strconv.FormatUint(fld.Uint(), 10)}, nil
+	}
+	return Attr{}, fmt.Errorf("attribute of kind %s not supported", fld.Kind())
+}
+
+// encodeText writes the string or []byte fld as the CharData of the current element.
+func (e *Encoder) encodeText(fld reflect.Value) error {
+	switch {
+	case fld.Kind() == reflect.String:
+		if fld.Len() == 0 {
+			return nil
+		}
+		return e.EncodeToken(CharData(fld.String()))
+	case fld.Kind() == reflect.Slice && fld.Type().Elem().Kind() == reflect.Uint8:
+		if fld.Len() == 0 {
+			return nil
+		}
+		return e.EncodeToken(CharData(fld.Bytes()))
+	default:
+		return fmt.Errorf(",chardata expected a string or []byte, got %s", fld.Kind())
+	}
+}
+
+// isEmptyText reports whether the ,chardata field fld is an empty string or []byte.
+func isEmptyText(fld reflect.Value) bool {
+	switch fld.Kind() {
+	case reflect.String, reflect.Slice:
+		return fld.Len() == 0
+	default:
+		return false
+	}
+}
+
+var (
+	marshalerType      = reflect.TypeOf((*Marshaler)(nil)).Elem()
+	tokenMarshalerType = reflect.TypeOf((*TokenMarshaler)(nil)).Elem()
+)
+
+// isMarshaler reports whether typ implements Marshaler or TokenMarshaler.
+func isMarshaler(typ reflect.Type) bool {
+	return typ.Implements(marshalerType) || typ.Implements(tokenMarshalerType)
+}
+
+// ValidateEncodable checks that the fields of the type of v can be encoded with the tags
+// and attrs code spaces, and returns an error for each field whose name is in neither,
+// instead of stopping at the first one as EncodeElement does. The types of the fields are
+// checked in turn, except the ones implementing Marshaler or TokenMarshaler.
+func ValidateEncodable(v interface{}, tags, attrs CodeSpace) []error {
+	e := NewEncoder(ioutil.Discard, tags, attrs)
+	var errs []error
+	e.validateType(reflect.TypeOf(v), make(map[reflect.Type]bool), &errs)
+	return errs
+}
+
+func (e *Encoder) validateType(typ reflect.Type, seen map[reflect.Type]bool, errs *[]error) {
+	for typ != nil && (typ.Kind() == reflect.Ptr || typ.Kind() == reflect.Slice) {
+		if isMarshaler(typ) || typ.Kind() == reflect.Slice && typ.Elem().Kind() == reflect.Uint8 {
+			return
+		}
+		typ = typ.Elem()
+	}
+	if typ == nil || typ.Kind() != reflect.Struct || seen[typ] || isMarshaler(typ) || isMarshaler(reflect.PtrTo(typ)) {
+		return
+	}
+	seen[typ] = true
+	for i := 0; i < typ.NumField(); i++ {
+		sf := typ.Field(i)
+		_, opts := parseTag(sf.Tag.Get("wbxml"))
+		if sf.PkgPath != "" {
+			continue
+		}
+		switch {
+		case opts.Contains("attr"):
+			if _, _, err := e.attribute(fieldName(sf)); err != nil {
+				*errs = append(*errs, fmt.Errorf("%s.%s: unknown attribute %s", typ.Name(), sf.Name, fieldName(sf)))
+			}
+		case !opts.isElement() || e.omitUnknown(fieldName(sf), opts):
+		default:
+			if _, _, err := e.tag(fieldName(sf)); err != nil {
+				*errs = append(*errs, fmt.Errorf("%s.%s: %s", typ.Name(), sf.Name, err))
+			}
+			e.validateType(sf.Type, seen, errs)
+		}
+	}
+}
+
+// isSkipped reports whether encoding the struct field fld writes nothing: unexported
+// fields, nil pointers and interfaces, and false booleans.
+func isSkipped(fld reflect.Value) bool {
+	if !fld.IsValid() || !fld.CanInterface() {
+		return true
+	}
+	switch fld.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if fld.IsNil() {
+			return true
+		}
+	}
+	switch fld.Interface().(type) {
+	case Marshaler, TokenMarshaler:
+		return false
+	}
+	return fld.Kind() == reflect.Bool && !fld.Bool()
+}
+
 // tag return the tag code, page or and error.
 // tag is -1 if no switch page is needed
 func (e *Encoder) tag(tag string) (byte, byte, error) {
 	return findCodePage(e.tags, tag)
 }
 
+// omitField reports whether the struct field fld is not written at all: tagged
+// ,omitunknown without a code, or tagged ,omitempty with an empty value.
+func (e *Encoder) omitField(name string, fld reflect.Value, opts tagOptions) bool {
+	return e.omitUnknown(name, opts) || opts.Contains("omitempty") && isEmptyValue(fld)
+}
+
+// isEmptyValue reports whether fld is empty for ,omitempty: a nil pointer or interface,
+// an empty string, slice or map, a zero number or false.
+func isEmptyValue(fld reflect.Value) bool {
+	switch fld.Kind() {
+	case reflect.String, reflect.Slice, reflect.Map:
+		return fld.Len() == 0
+	case reflect.Ptr, reflect.Interface:
+		return fld.IsNil()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return fld.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return fld.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return fld.Float() == 0
+	case reflect.Bool:
+		return !fld.Bool()
+	}
+	return false
+}
+
+// omitUnknown reports whether a field tagged ,omitunknown is skipped, its name having
+// no code in the tag CodeSpace.
+func (e *Encoder) omitUnknown(name string, opts tagOptions) bool {
+	if !opts.Contains("omitunknown") {
+		return false
+	}
+	_, _, err := e.tag(name)
+	return err != nil
+}
+
 func (e *Encoder) attribute(tag string) (byte, byte, error) {
 	return findCodePage(e.attrs, tag)
 }
@@ -273,12 +743,22 @@ func findCodePage(space CodeSpace, tag string) (byte, byte, error) {
 
 func (e *Encoder) encodeTag(tok StartElement) error {
 	code, page, err := e.tag(tok.Name)
+	var index uint32
+	literal := false
 	if err != nil {
-		return err
-	}
-	err = e.switchTagPage(page)
-	if err != nil {
-		return err
+		if !e.LiteralTags {
+			return err
+		}
+		index, literal = e.literalIndex(tok.Name)
+		if !literal {
+			return fmt.Errorf("%s, and not in the string table", err)
+		}
+		code = gloLiteral
+	} else {
+		err = e.switchTagPage(page)
+		if err != nil {
+			return err
+		}
 	}
 	finalCode := code
 	if len(tok.Attr) != 0 {
@@ -294,6 +774,12 @@ func (e *Encoder) encodeTag(tok StartElement) error {
 	if err != nil {
 		return err
 	}
+	if literal {
+		err = writeMbUint32(e, index)
+		if err != nil {
+			return err
+		}
+	}
 
 	return e.encodeAttrs(tok.Attr)
 }
@@ -303,24 +789,14 @@ func (e *Encoder) encodeAttrs(attrs []Attr) error {
 		return nil
 	}
 	for _, attr := range attrs {
-		code, page, err := e.attribute(attr.Name)
-		if err != nil {
-			return err
-		}
-
-		err = e.switchTagPage(page)
+		err := e.encodeAttrName(attr.Name)
 		if err != nil {
 			return err
 		}
 
-		err = writeByte(e, code)
-		if err != nil {
-			return err
-		}
-
-		code, page, err = e.attribute(attr.Value)
+		code, page, err := e.attribute(attr.Value)
 		if err == nil {
-			err := e.switchTagPage(page)
+			err := e.switchAttrPage(page)
 			if err != nil {
 				return err
 			}
@@ -329,27 +805,70 @@ func (e *Encoder) encodeAttrs(attrs []Attr) error {
 				return err
 			}
 		} else {
-			e.writeString([]byte(attr.Value))
+			err := e.writeString([]byte(attr.Value))
+			if err != nil {
+				return err
+			}
 		}
 	}
 	return writeByte(e, gloEnd)
 }
 
+// encodeAttrName writes the start of the attribute name. A name missing from the attrs
+// CodeSpace is written as a LITERAL, if it is in the string table.
+func (e *Encoder) encodeAttrName(name string) error {
+	code, page, err := e.attribute(name)
+	if err != nil {
+		index, ok := e.literalIndex(name)
+		if !ok {
+			return err
+		}
+		err := writeByte(e, gloLiteral)
+		if err != nil {
+			return err
+		}
+		return writeMbUint32(e, index)
+	}
+	err = e.switchAttrPage(page)
+	if err != nil {
+		return err
+	}
+	return writeByte(e, code)
+}
+
+// literalIndex returns the index of name in the string table, for a LITERAL. While the
+// header is deferred, name is added to the table if it is not found.
+func (e *Encoder) literalIndex(name string) (uint32, bool) {
+	index, ok := e.GetIndex([]byte(name))
+	if !ok && e.literals != nil && name != "" {
+		e.countString(name)
+		e.literals[name] = true
+		return 0, true
+	}
+	if !ok && e.deferred != nil && name != "" {
+		return e.AddString([]byte(name)), true
+	}
+	return index, ok
+}
+
+// isLiteral reports whether name is in the string table, to be written as a LITERAL.
+func (e *Encoder) isLiteral(name string) bool {
+	_, ok := e.GetIndex([]byte(name))
+	return ok || e.literals[name]
+}
+
 func (e *Encoder) encodeEnd(tok EndElement) error {
 	ilen := len(e.ignoreEnd)
 	if ilen > 0 && tok.Name == e.ignoreEnd[ilen-1] {
 		e.ignoreEnd = e.ignoreEnd[:ilen-1]
 		return nil
 	}
-	_, page, err := e.tag(tok.Name)
-	if err != nil {
-		return err
-	}
-	err = writeByte(e, gloEnd)
-	if err != nil {
+	_, _, err := e.tag(tok.Name)
+	if err != nil && !(e.LiteralTags && e.isLiteral(tok.Name)) {
 		return err
 	}
-	return e.switchTagPage(page)
+	// END is a global token: the page only changes when the next tag requires it
+	return writeByte(e, gloEnd)
 }
 
 func (e *Encoder) switchTagPage(p byte) error {
@@ -377,7 +896,19 @@ func (e *Encoder) switchAttrPage(p byte) error {
 }
 
 func (e *Encoder) writeString(cdata CharData) error {
-	if index, ok := e.GetIndex(cdata); ok {
+	index, ok := e.GetIndex(cdata)
+	table := true
+	if e.ShouldTable != nil && len(cdata) > 0 {
+		table = e.ShouldTable(cdata, index, ok)
+		if table && !ok && e.deferred != nil {
+			index, ok = e.AddString(cdata), true
+		}
+		ok = ok && table
+	}
+	if e.strCount != nil && table && len(cdata) > 0 {
+		e.countString(string(cdata))
+	}
+	if ok {
 		err := writeByte(e, gloStrT)
 		if err != nil {
 			return err
@@ -399,6 +930,38 @@ func (e *Encoder) writeString(cdata CharData) error {
 	return writeString(e, cdata)
 }
 
+// countString records a use of str while scanning the document for EncodeDocument.
+func (e *Encoder) countString(str string) {
+	if e.strCount[str] == 0 {
+		e.strOrder = append(e.strOrder, str)
+	}
+	e.strCount[str]++
+}
+
+func (e *Encoder) writeExtension(tok Extension) error {
+	if tok.ID > 2 {
+		return fmt.Errorf("extension %d out of range, expected 0, 1 or 2", tok.ID)
+	}
+	switch tok.Kind {
+	case ExtString:
+		err := writeByte(e, gloExtI0+tok.ID)
+		if err != nil {
+			return err
+		}
+		return writeString(e, tok.Data)
+	case ExtInteger:
+		err := writeByte(e, gloExtT0+tok.ID)
+		if err != nil {
+			return err
+		}
+		return writeMbUint32(e, tok.Index)
+	case ExtByte:
+		return writeByte(e, gloExt0+tok.ID)
+	default:
+		return fmt.Errorf("unknown extension kind %d", tok.Kind)
+	}
+}
+
 func (e *Encoder) writeEntity(tok Entity) error {
 	err := writeByte(e, gloEntity)
 	if err != nil {
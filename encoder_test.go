@@ -2,8 +2,11 @@ package wbxml
 
 import (
 	"bytes"
+	"errors"
 	"os"
+	"reflect"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -73,6 +76,12 @@ func TestEncoderToken(t *testing.T) {
 	}
 }
 
+// syncMLEncoded is syncMLInput as written by Encoder, which does not switch back to the
+// page of the elements of page 1 and 8 after their END.
+var syncMLEncoded = bytes.Replace(syncMLInput,
+	[]byte{0xa9, 0x01, 0x01, 0x00, 0x01, 0x01, 0x00, 0x00, 0x01, 0x6b},
+	[]byte{0xa9, 0x01, 0x01, 0x01, 0x01, 0x00, 0x00, 0x6b}, 1)
+
 type fullmsg struct {
 	SyncHdr  fullheader
 	SyncBody body
@@ -135,7 +144,7 @@ func TestEncoderEncode(t *testing.T) {
 		t.Errorf("unexpected error: %s", err)
 	}
 
-	if !assert.Equal(t, syncMLInput, w.Bytes()) {
+	if !assert.Equal(t, syncMLEncoded, w.Bytes()) {
 		XML(os.Stdout, NewDecoder(w, syncMLTags, CodeSpace{}), " ")
 	}
 }
@@ -216,7 +225,1182 @@ func TestEncoderEncodeWithMarshalWBXML(t *testing.T) {
 		t.Errorf("unexpected error: %s", err)
 	}
 
-	if !assert.Equal(t, syncMLInput, w.Bytes()) {
+	if !assert.Equal(t, syncMLEncoded, w.Bytes()) {
 		XML(os.Stdout, NewDecoder(w, syncMLTags, CodeSpace{}), " ")
 	}
 }
+
+type emptyBody struct {
+	Status *status
+	Final  bool
+}
+
+type emptyMsg struct {
+	SyncBody emptyBody
+}
+
+func TestEncoderEncodeEmptyStruct(t *testing.T) {
+	w := bytes.NewBuffer(nil)
+	e := NewEncoder(w, syncMLTags, CodeSpace{})
+	err := e.EncodeHeader(Header{Version: 3, PublicID: 1, Charset: 106})
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	err = e.EncodeElement(emptyMsg{}, StartElement{Name: "SyncML"})
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+
+	// SyncML with content, SyncBody without content, END
+	expected := []byte{0x03, 0x01, 0x6A, 0x00, 0x6D, 0x2B, 0x01}
+	assert.Equal(t, expected, w.Bytes())
+}
+
+func TestEncoderEncodeDocument(t *testing.T) {
+	hdr := header{
+		VerDTD:    "1.2",
+		VerProto:  "1.2",
+		SessionID: "1.2",
+		MsgID:     1,
+		Source:    endpoint{LocURI: "tcp://example.com/sync"},
+		Target:    endpoint{LocURI: "tcp://example.com/sync"},
+	}
+	h := Header{Version: 3, PublicID: 1, Charset: 106}
+
+	naive := bytes.NewBuffer(nil)
+	e := NewEncoder(naive, syncMLTags, CodeSpace{})
+	err := e.EncodeHeader(h)
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	err = e.EncodeElement(hdr, StartElement{Name: "SyncHdr"})
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+
+	tabled := bytes.NewBuffer(nil)
+	e = NewEncoder(tabled, syncMLTags, CodeSpace{})
+	e.Header = h
+	err = e.EncodeDocument(hdr, StartElement{Name: "SyncHdr"})
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+
+	assert.Equal(t, []byte("1.2\x00tcp://example.com/sync\x00"), e.Header.StringTable)
+	if tabled.Len() >= naive.Len() {
+		t.Errorf("expected less than %d bytes, got %d", naive.Len(), tabled.Len())
+	}
+
+	var result header
+	err = NewDecoder(tabled, syncMLTags, CodeSpace{}).Decode(&result)
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	assert.Equal(t, hdr, result)
+}
+
+func TestEncoderEncodeDocumentOptions(t *testing.T) {
+	h := Header{Version: 3, PublicID: 1, Charset: 106}
+
+	w := bytes.NewBuffer(nil)
+	e := NewEncoder(w, syncMLTags, CodeSpace{})
+	e.Header = h
+	e.UseStringer = true
+	date := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	err := e.EncodeDocument(timeMsg{Data: date}, StartElement{Name: "SyncML"})
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+
+	// a literal tag is tabled even if used once
+	var literal struct {
+		Data  string
+		Extra string
+	}
+	literal.Data, literal.Extra = "x", "y"
+	w.Reset()
+	e = NewEncoder(w, syncMLTags, CodeSpace{})
+	e.Header = h
+	e.LiteralTags = true
+	err = e.EncodeDocument(literal, StartElement{Name: "SyncML"})
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	assert.Equal(t, []byte("Extra\x00"), e.Header.StringTable)
+
+	// only the strings accepted by ShouldTable are tabled
+	hdr := header{VerDTD: "1.2", VerProto: "1.2", SessionID: "abc", Source: endpoint{LocURI: "abc"}}
+	w.Reset()
+	e = NewEncoder(w, syncMLTags, CodeSpace{})
+	e.Header = h
+	e.ShouldTable = func(s []byte, index uint32, inTable bool) bool {
+		return len(s) > 3
+	}
+	err = e.EncodeDocument(hdr, StartElement{Name: "SyncHdr"})
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	assert.Equal(t, []byte(nil), e.Header.StringTable)
+}
+
+type chunksMsg struct {
+	Data [][]byte
+}
+
+func TestEncoderEncodeByteSlices(t *testing.T) {
+	m := chunksMsg{Data: [][]byte{{0x01, 0x02}, {0x03}, {0x04, 0x05, 0x06}}}
+
+	w := bytes.NewBuffer(nil)
+	e := NewEncoder(w, syncMLTags, CodeSpace{})
+	err := e.EncodeHeader(Header{Version: 3, PublicID: 1, Charset: 106})
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	err = e.EncodeElement(m, StartElement{Name: "SyncML"})
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	expected := []byte{0x03, 0x01, 0x6A, 0x00, 0x6D, 0x4F,
+		0xC3, 0x02, 0x01, 0x02,
+		0xC3, 0x01, 0x03,
+		0xC3, 0x03, 0x04, 0x05, 0x06,
+		0x01, 0x01}
+	assert.Equal(t, expected, w.Bytes())
+
+	var result chunksMsg
+	err = NewDecoder(w, syncMLTags, CodeSpace{}).Decode(&result)
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	assert.Equal(t, m, result)
+}
+
+type durationMsg struct {
+	Data time.Duration
+}
+
+func TestEncoderEncodeStringer(t *testing.T) {
+	w := bytes.NewBuffer(nil)
+	e := NewEncoder(w, syncMLTags, CodeSpace{})
+	e.UseStringer = true
+	err := e.EncodeHeader(Header{Version: 3, PublicID: 1, Charset: 106})
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	err = e.EncodeElement(durationMsg{Data: 90 * time.Second}, StartElement{Name: "SyncML"})
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+
+	expected := []byte{0x03, 0x01, 0x6A, 0x00, 0x6D, 0x4F, 0x03, '1', 'm', '3', '0', 's', 0x00, 0x01, 0x01}
+	assert.Equal(t, expected, w.Bytes())
+}
+
+type ptrStringer struct {
+	id string
+}
+
+func (s *ptrStringer) String() string {
+	return "#" + s.id
+}
+
+type ptrStringerMsg struct {
+	Data ptrStringer
+}
+
+func TestEncoderEncodePtrStringer(t *testing.T) {
+	w := bytes.NewBuffer(nil)
+	e := NewEncoder(w, syncMLTags, CodeSpace{})
+	e.UseStringer = true
+	err := e.EncodeHeader(Header{Version: 3, PublicID: 1, Charset: 106})
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	err = e.EncodeElement(&ptrStringerMsg{Data: ptrStringer{id: "7"}}, StartElement{Name: "SyncML"})
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	err = e.EncodeElement(&ptrStringer{id: "8"}, StartElement{Name: "Data"})
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+
+	expected := []byte{0x03, 0x01, 0x6A, 0x00, 0x6D, 0x4F, 0x03, '#', '7', 0x00, 0x01, 0x01,
+		0x4F, 0x03, '#', '8', 0x00, 0x01}
+	assert.Equal(t, expected, w.Bytes())
+}
+
+func TestEncoderEncodeCharDataField(t *testing.T) {
+	space := tagSpaceExamples[1]
+	w := bytes.NewBuffer(nil)
+	e := NewEncoder(w, space.tags, space.attrs)
+	err := e.EncodeHeader(Header{Version: 1, PublicID: 1, Charset: 106})
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	deck := wmlTextDeck{
+		CARD: wmlTextCard{NAME: "abc", Text: " Enter name: "},
+	}
+	err = e.EncodeElement(deck, StartElement{Name: "XYZ"})
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+
+	expected := []byte{0x01, 0x01, 0x6A, 0x00, 0x47,
+		0xC5, 0x09, 0x03, 'a', 'b', 'c', 0x00, 0x01,
+		0x03, ' ', 'E', 'n', 't', 'e', 'r', ' ', 'n', 'a', 'm', 'e', ':', ' ', 0x00,
+		0x01, 0x01}
+	assert.Equal(t, expected, w.Bytes())
+
+	var result wmlTextDeck
+	err = NewDecoder(w, space.tags, space.attrs).Decode(&result)
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	assert.Equal(t, deck, result)
+}
+
+func TestEncoderSwitchPage(t *testing.T) {
+	tokens := []Token{
+		StartElement{Name: "SyncML", Content: true},
+		StartElement{Name: "Add"},
+		EndElement{Name: "Add"},
+		StartElement{Name: "CS"},
+		EndElement{Name: "CS"},
+		StartElement{Name: "CS"},
+		EndElement{Name: "CS"},
+		StartElement{Name: "Alert", Content: true},
+		CharData("x"),
+		EndElement{Name: "Alert"},
+		StartElement{Name: "CS", Content: true},
+		CharData("y"),
+		EndElement{Name: "CS"},
+		StartElement{Name: "Add"},
+		EndElement{Name: "Add"},
+		EndElement{Name: "SyncML"},
+	}
+
+	w := bytes.NewBuffer(nil)
+	e := NewEncoder(w, syncMLTags, CodeSpace{})
+	for _, tok := range tokens {
+		err := e.EncodeToken(tok)
+		if err != nil {
+			t.Errorf("error: token %v: %s", tok, err)
+		}
+	}
+
+	expected := []byte{0x6D,
+		0x05,
+		0x00, 0x08, 0x05,
+		0x05,
+		0x00, 0x00, 0x46, 0x03, 'x', 0x00, 0x01,
+		0x00, 0x08, 0x45, 0x03, 'y', 0x00, 0x01,
+		0x00, 0x00, 0x05,
+		0x01}
+	assert.Equal(t, expected, w.Bytes())
+}
+
+func TestEncoderSwitchPageNested(t *testing.T) {
+	tokens := []Token{
+		StartElement{Name: "SyncML", Content: true},
+		StartElement{Name: "CS", Content: true},
+		StartElement{Name: "Add"},
+		EndElement{Name: "Add"},
+		EndElement{Name: "CS"},
+		EndElement{Name: "SyncML"},
+	}
+
+	w := bytes.NewBuffer(nil)
+	e := NewEncoder(w, syncMLTags, CodeSpace{})
+	for _, tok := range tokens {
+		err := e.EncodeToken(tok)
+		if err != nil {
+			t.Errorf("error: token %v: %s", tok, err)
+		}
+	}
+
+	// no SWITCH_PAGE after the END of CS
+	expected := []byte{0x6D, 0x00, 0x08, 0x45, 0x00, 0x00, 0x05, 0x01, 0x01}
+	assert.Equal(t, expected, w.Bytes())
+}
+
+func TestEncoderWriteRaw(t *testing.T) {
+	raw := bytes.NewBuffer(nil)
+	e := NewEncoder(raw, syncMLTags, CodeSpace{})
+	err := e.EncodeElement("x", StartElement{Name: "Alert"})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	w := bytes.NewBuffer(nil)
+	e = NewEncoder(w, syncMLTags, CodeSpace{})
+	for _, tok := range []Token{
+		StartElement{Name: "SyncML", Content: true},
+		StartElement{Name: "Add"},
+		EndElement{Name: "Add"},
+	} {
+		err := e.EncodeToken(tok)
+		if err != nil {
+			t.Errorf("error: token %v: %s", tok, err)
+		}
+	}
+	err = e.WriteRaw(raw.Bytes())
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	for _, tok := range []Token{
+		StartElement{Name: "Add"},
+		EndElement{Name: "Add"},
+		EndElement{Name: "SyncML"},
+	} {
+		err := e.EncodeToken(tok)
+		if err != nil {
+			t.Errorf("error: token %v: %s", tok, err)
+		}
+	}
+
+	expected := []byte{0x6D, 0x05, 0x46, 0x03, 'x', 0x00, 0x01, 0x05, 0x01}
+	assert.Equal(t, expected, w.Bytes())
+	assert.Equal(t, len(expected), e.offset)
+}
+
+func TestEncoderGetIndex(t *testing.T) {
+	e := NewEncoder(nil, nil, nil)
+	e.Header = headerExamples[1]
+
+	tests := []struct {
+		str   string
+		index uint32
+		found bool
+	}{
+		{"abc", 0, true},
+		{" Enter name: ", 4, true},
+		{"Enter name: ", 5, true},
+		{"name: ", 11, true},
+		{"bc", 1, true},
+		{"Enter", 0, false},
+		{"abc Enter name: ", 0, false},
+		{"", 0, false},
+	}
+	for testID, test := range tests {
+		index, found := e.GetIndex([]byte(test.str))
+		assert.Equal(t, test.found, found, "case %d", testID)
+		assert.Equal(t, test.index, index, "case %d", testID)
+	}
+}
+
+func TestEncoderEncodeAttrsField(t *testing.T) {
+	space := tagSpaceExamples[1]
+	var deck struct {
+		CARD wmlAttrsCard
+	}
+	err := NewDecoder(bytes.NewReader(decodingExamples[1]), space.tags, space.attrs).Decode(&deck)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	w := bytes.NewBuffer(nil)
+	e := NewEncoder(w, space.tags, space.attrs)
+	err = e.EncodeHeader(Header{Version: 1, PublicID: 1, Charset: 106})
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	err = e.EncodeElement(deck, StartElement{Name: "XYZ"})
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	expected := []byte{0x01, 0x01, 0x6A, 0x00, 0x47, 0x45,
+		0x88, 0x06, 0x86, 0x08, 0x03, 'x', 'y', 'z', '.', 'o', 'r', 'g', '/', 's', 0x00, 0x01,
+		0x01, 0x01}
+	assert.Equal(t, expected, w.Bytes())
+
+	var result struct {
+		CARD wmlAttrsCard
+	}
+	err = NewDecoder(w, space.tags, space.attrs).Decode(&result)
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	assert.Equal(t, deck, result)
+}
+
+func TestEncoderEncodeUnexportedAttrsField(t *testing.T) {
+	space := tagSpaceExamples[1]
+	v := struct {
+		attrs []Attr `wbxml:",attrs"`
+		URL   string `wbxml:",attr"`
+	}{attrs: []Attr{{"TYPE", "ACCEPT"}}, URL: "xyz"}
+
+	w := bytes.NewBuffer(nil)
+	err := NewEncoder(w, space.tags, space.attrs).EncodeElement(v, StartElement{Name: "DO"})
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	assert.Equal(t, []byte{0x88, 0x08, 0x03, 'x', 'y', 'z', 0x00, 0x01}, w.Bytes())
+}
+
+func TestEncoderDeferHeader(t *testing.T) {
+	w := bytes.NewBuffer(nil)
+	e := NewEncoder(w, syncMLTags, CodeSpace{})
+	e.DeferHeader(Header{Version: 3, PublicID: 1, Charset: 106})
+
+	err := e.EncodeToken(StartElement{Name: "SyncML", Content: true})
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	for _, str := range []string{"Put", "abc", "Put"} {
+		e.AddString([]byte(str))
+		err := e.EncodeElement(str, StartElement{Name: "Data"})
+		if err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+	}
+	err = e.EncodeToken(EndElement{Name: "SyncML"})
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	assert.Equal(t, 0, w.Len())
+
+	err = e.Flush()
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	expected := []byte{0x03, 0x01, 0x6A, 0x08, 'P', 'u', 't', 0x00, 'a', 'b', 'c', 0x00,
+		0x6D,
+		0x4F, 0x83, 0x00, 0x01,
+		0x4F, 0x83, 0x04, 0x01,
+		0x4F, 0x83, 0x00, 0x01,
+		0x01}
+	assert.Equal(t, expected, w.Bytes())
+	assert.Equal(t, len(expected), e.offset)
+
+	d := NewDecoder(w, syncMLTags, CodeSpace{})
+	_, err = d.DecodeAll()
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	assert.Equal(t, e.Header.StringTable, d.Header.StringTable)
+}
+
+func TestEncoderShouldTable(t *testing.T) {
+	longer := func(s []byte, index uint32, inTable bool) bool {
+		return len(s) > 8
+	}
+	strs := []string{"abc", "tcp://Accueil", "abc", "tcp://Accueil"}
+
+	w := bytes.NewBuffer(nil)
+	e := NewEncoder(w, syncMLTags, CodeSpace{})
+	e.ShouldTable = longer
+	err := e.EncodeHeader(Header{Version: 3, PublicID: 1, Charset: 106, StringTable: []byte("abc\x00tcp://Accueil\x00")})
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	for _, str := range strs {
+		err := e.EncodeToken(CharData(str))
+		if err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+	}
+	expected := []byte{0x03, 0x01, 0x6A, 0x12, 'a', 'b', 'c', 0x00, 't', 'c', 'p', ':', '/', '/', 'A', 'c', 'c', 'u', 'e', 'i', 'l', 0x00,
+		0x03, 'a', 'b', 'c', 0x00, 0x83, 0x04,
+		0x03, 'a', 'b', 'c', 0x00, 0x83, 0x04}
+	assert.Equal(t, expected, w.Bytes())
+
+	// with a deferred header, the strings are added to the table
+	w = bytes.NewBuffer(nil)
+	e = NewEncoder(w, syncMLTags, CodeSpace{})
+	e.ShouldTable = longer
+	e.DeferHeader(Header{Version: 3, PublicID: 1, Charset: 106})
+	for _, str := range strs {
+		err := e.EncodeToken(CharData(str))
+		if err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+	}
+	err = e.Flush()
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	expected = []byte{0x03, 0x01, 0x6A, 0x0E, 't', 'c', 'p', ':', '/', '/', 'A', 'c', 'c', 'u', 'e', 'i', 'l', 0x00,
+		0x03, 'a', 'b', 'c', 0x00, 0x83, 0x00,
+		0x03, 'a', 'b', 'c', 0x00, 0x83, 0x00}
+	assert.Equal(t, expected, w.Bytes())
+}
+
+func TestEncoderSwitchPageTokens(t *testing.T) {
+	for _, emit := range []bool{false, true} {
+		d := NewDecoder(bytes.NewReader(syncMLInput), syncMLTags, CodeSpace{})
+		d.EmitSwitchPage = emit
+		toks, err := d.DecodeAll()
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		w := bytes.NewBuffer(nil)
+		e := NewEncoder(w, syncMLTags, CodeSpace{})
+		err = e.EncodeHeader(d.Header)
+		if err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		for _, tok := range toks {
+			err := e.EncodeToken(tok)
+			if err != nil {
+				t.Errorf("error: token %v: %s", tok, err)
+			}
+		}
+
+		if emit {
+			// SWITCH_PAGE at the same places than the original document
+			assert.Equal(t, syncMLInput, w.Bytes())
+		} else {
+			assert.Equal(t, syncMLEncoded, w.Bytes())
+		}
+	}
+}
+
+func TestEncoderAttrPage(t *testing.T) {
+	tags := tagSpaceExamples[1].tags
+	attrs := CodeSpace{
+		0: CodePage{0x05: "STYLE"},
+		1: CodePage{0x06: "TYPE", 0x08: "URL", 0x86: "ACCEPT"},
+	}
+	tokens := []Token{
+		StartElement{Name: "XYZ", Content: true},
+		StartElement{Name: "DO", Attr: []Attr{{"TYPE", "ACCEPT"}, {"URL", "xyz"}}},
+		EndElement{Name: "DO"},
+		StartElement{Name: "CARD"},
+		EndElement{Name: "CARD"},
+		EndElement{Name: "XYZ"},
+	}
+
+	w := bytes.NewBuffer(nil)
+	e := NewEncoder(w, tags, attrs)
+	err := e.EncodeHeader(Header{Version: 1, PublicID: 1, Charset: 106})
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	for _, tok := range tokens {
+		err := e.EncodeToken(tok)
+		if err != nil {
+			t.Errorf("error: token %v: %s", tok, err)
+		}
+	}
+
+	expected := []byte{0x01, 0x01, 0x6A, 0x00,
+		0x47,
+		0x88, 0x00, 0x01, 0x06, 0x86, 0x08, 0x03, 'x', 'y', 'z', 0x00, 0x01,
+		0x05,
+		0x01}
+	assert.Equal(t, expected, w.Bytes())
+	assert.Equal(t, byte(0), e.tagPage)
+	assert.Equal(t, byte(1), e.attrPage)
+
+	toks, err := NewDecoder(w, tags, attrs).DecodeAll()
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	assert.Equal(t, tokens[1].(StartElement).Attr, toks[1].(StartElement).Attr)
+}
+
+func TestEncoderTagPageWithAttrs(t *testing.T) {
+	tags := CodeSpace{
+		0: CodePage{0x07: "XYZ"},
+		1: CodePage{0x05: "CARD", 0x08: "DO"},
+	}
+	attrs := tagSpaceExamples[1].attrs
+	tokens := []Token{
+		StartElement{Name: "XYZ", Content: true},
+		StartElement{Name: "DO", Attr: []Attr{{"TYPE", "ACCEPT"}, {"URL", "xyz"}}},
+		EndElement{Name: "DO"},
+		StartElement{Name: "CARD"},
+		EndElement{Name: "CARD"},
+		EndElement{Name: "XYZ"},
+	}
+
+	w := bytes.NewBuffer(nil)
+	e := NewEncoder(w, tags, attrs)
+	err := e.EncodeHeader(Header{Version: 1, PublicID: 1, Charset: 106})
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	for _, tok := range tokens {
+		err := e.EncodeToken(tok)
+		if err != nil {
+			t.Errorf("error: token %v: %s", tok, err)
+		}
+	}
+
+	// attributes stay on page 0 while the tags switch to page 1
+	expected := []byte{0x01, 0x01, 0x6A, 0x00,
+		0x47,
+		0x00, 0x01, 0x88, 0x06, 0x86, 0x08, 0x03, 'x', 'y', 'z', 0x00, 0x01,
+		0x05,
+		0x01}
+	assert.Equal(t, expected, w.Bytes())
+	assert.Equal(t, byte(1), e.tagPage)
+	assert.Equal(t, byte(0), e.attrPage)
+
+	toks, err := NewDecoder(w, tags, attrs).DecodeAll()
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	assert.Equal(t, tokens[1].(StartElement).Attr, toks[1].(StartElement).Attr)
+}
+
+func TestEncoderOmitUnknown(t *testing.T) {
+	space := tagSpaceExamples[0]
+	type card struct {
+		BR    string
+		EXTRA string `wbxml:",omitunknown"`
+	}
+	var deck struct {
+		CARD card
+	}
+	deck.CARD.BR = "X"
+	deck.CARD.EXTRA = "Y"
+
+	w := bytes.NewBuffer(nil)
+	e := NewEncoder(w, space.tags, space.attrs)
+	err := e.EncodeHeader(Header{Version: 1, PublicID: 1, Charset: 106})
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	err = e.EncodeElement(deck, StartElement{Name: "XYZ"})
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	expected := []byte{0x01, 0x01, 0x6A, 0x00, 0x47, 0x46, 0x45, 0x03, 'X', 0x00, 0x01, 0x01, 0x01}
+	assert.Equal(t, expected, w.Bytes())
+
+	type strictCard struct {
+		BR    string
+		EXTRA string
+	}
+	err = NewEncoder(bytes.NewBuffer(nil), space.tags, space.attrs).EncodeElement(strictCard{"X", "Y"}, StartElement{Name: "CARD"})
+	assert.NotNil(t, err)
+}
+
+var errWriteFailed = errors.New("write failed")
+
+// failingWriter accepts n bytes, then fails every write.
+type failingWriter struct {
+	n int
+}
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	if len(p) > w.n {
+		n := w.n
+		w.n = 0
+		return n, errWriteFailed
+	}
+	w.n -= len(p)
+	return len(p), nil
+}
+
+func TestEncoderClose(t *testing.T) {
+	e := NewEncoder(&failingWriter{n: 5}, syncMLTags, CodeSpace{})
+	err := e.EncodeHeader(Header{Version: 3, PublicID: 1, Charset: 106})
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	// errors of the body are ignored, until Close
+	e.EncodeElement("abc", StartElement{Name: "Data"})
+	e.EncodeToken(EndElement{Name: "Data"})
+	err = e.Close()
+	assert.Equal(t, errWriteFailed, err)
+
+	e = NewEncoder(bytes.NewBuffer(nil), syncMLTags, CodeSpace{})
+	e.DeferHeader(Header{Version: 3, PublicID: 1, Charset: 106})
+	err = e.EncodeElement("abc", StartElement{Name: "Data"})
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	assert.Nil(t, e.Close())
+}
+
+func TestEncoderEncodeBinaryText(t *testing.T) {
+	tests := []struct {
+		msg      interface{}
+		result   interface{}
+		expected string
+	}{
+		{hexMsg{Data: []byte{0x01, 0x02, 0xFF}}, &hexMsg{}, "0102ff"},
+		{base64Msg{Data: []byte{0x01, 0x02, 0xFF}}, &base64Msg{}, "AQL/"},
+	}
+	for testID, test := range tests {
+		w := bytes.NewBuffer(nil)
+		e := NewEncoder(w, syncMLTags, CodeSpace{})
+		err := e.EncodeHeader(Header{Version: 3, PublicID: 1, Charset: 106})
+		if err != nil {
+			t.Errorf("case %d: unexpected error: %s", testID, err)
+		}
+		err = e.EncodeElement(test.msg, StartElement{Name: "SyncML"})
+		if err != nil {
+			t.Errorf("case %d: unexpected error: %s", testID, err)
+		}
+		expected := append([]byte{0x03, 0x01, 0x6A, 0x00, 0x6D, 0x4F, 0x03}, test.expected...)
+		expected = append(expected, 0x00, 0x01, 0x01)
+		assert.Equal(t, expected, w.Bytes(), "case %d", testID)
+
+		err = NewDecoder(w, syncMLTags, CodeSpace{}).Decode(test.result)
+		if err != nil {
+			t.Errorf("case %d: unexpected error: %s", testID, err)
+		}
+		assert.Equal(t, test.msg, reflect.ValueOf(test.result).Elem().Interface(), "case %d", testID)
+	}
+}
+
+func TestEncoderAutoHeader(t *testing.T) {
+	w := bytes.NewBuffer(nil)
+	e := NewEncoder(w, syncMLTags, CodeSpace{})
+	e.AutoHeader = true
+	err := e.EncodeElement("abc", StartElement{Name: "Data"})
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	expected := []byte{0x03, 0x01, 0x6A, 0x00, 0x4F, 0x03, 'a', 'b', 'c', 0x00, 0x01}
+	assert.Equal(t, expected, w.Bytes())
+
+	d := NewDecoder(w, syncMLTags, CodeSpace{})
+	var data string
+	err = d.Decode(&data)
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	assert.Equal(t, "abc", data)
+	assert.Equal(t, Header{Version: 3, PublicID: 1, Charset: 106, StringTable: []byte{}}, d.Header)
+
+	// an explicit header is kept
+	w.Reset()
+	e = NewEncoder(w, syncMLTags, CodeSpace{})
+	e.AutoHeader = true
+	err = e.EncodeHeader(Header{Version: 1, PublicID: 1, Charset: 3})
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	err = e.EncodeElement("abc", StartElement{Name: "Data"})
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	assert.Equal(t, []byte{0x01, 0x01, 0x03, 0x00, 0x4F}, w.Bytes()[:5])
+}
+
+func TestEncoderMultipleDocuments(t *testing.T) {
+	d := NewDecoder(bytes.NewReader(syncMLEncoded), syncMLTags, CodeSpace{})
+	var msg fullmsg
+	err := d.Decode(&msg)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	w := bytes.NewBuffer(nil)
+	e := NewEncoder(w, syncMLTags, CodeSpace{})
+	for i := 0; i < 2; i++ {
+		err := e.EncodeHeader(d.Header)
+		if err != nil {
+			t.Errorf("frame %d: unexpected error: %s", i, err)
+		}
+		err = e.EncodeElement(msg, StartElement{Name: "SyncML"})
+		if err != nil {
+			t.Errorf("frame %d: unexpected error: %s", i, err)
+		}
+	}
+	assert.Equal(t, append(append([]byte{}, syncMLEncoded...), syncMLEncoded...), w.Bytes())
+
+	r := bytes.NewReader(w.Bytes())
+	for i := 0; i < 2; i++ {
+		var frame fullmsg
+		err := NewDecoder(r, syncMLTags, CodeSpace{}).Decode(&frame)
+		if err != nil {
+			t.Errorf("frame %d: unexpected error: %s", i, err)
+		}
+		assert.Equal(t, msg, frame, "frame %d", i)
+	}
+	assert.Equal(t, 0, r.Len())
+
+	// each frame switches again to the page of its root
+	w.Reset()
+	for i := 0; i < 2; i++ {
+		err := e.EncodeHeader(Header{Version: 3, PublicID: 1, Charset: 106})
+		if err != nil {
+			t.Errorf("frame %d: unexpected error: %s", i, err)
+		}
+		err = e.EncodeElement("abc", StartElement{Name: "EMI"})
+		if err != nil {
+			t.Errorf("frame %d: unexpected error: %s", i, err)
+		}
+	}
+	frame := []byte{0x03, 0x01, 0x6A, 0x00, 0x00, 0x01, 0x46, 0x03, 'a', 'b', 'c', 0x00, 0x01}
+	assert.Equal(t, append(append([]byte{}, frame...), frame...), w.Bytes())
+}
+
+type timeMsg struct {
+	Data time.Time
+}
+
+func TestEncoderEncodeTime(t *testing.T) {
+	date := time.Date(2020, 3, 14, 15, 9, 26, 0, time.UTC)
+	msg := timeMsg{Data: date}
+	e := NewEncoder(bytes.NewBuffer(nil), syncMLTags, CodeSpace{})
+	err := e.EncodeElement(msg, StartElement{Name: "SyncML"})
+	assert.Equal(t, errors.New("timeMsg.Data: time.Time not supported, implement Marshaler or set UseStringer"), err)
+
+	w := bytes.NewBuffer(nil)
+	e = NewEncoder(w, syncMLTags, CodeSpace{})
+	e.UseStringer = true
+	err = e.EncodeElement(msg, StartElement{Name: "SyncML"})
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	expected := append([]byte{0x6D, 0x4F, 0x03}, date.String()...)
+	assert.Equal(t, append(expected, 0x00, 0x01, 0x01), w.Bytes())
+}
+
+func TestEncoderLiteralAttrs(t *testing.T) {
+	space := tagSpaceExamples[1]
+	d := NewDecoder(bytes.NewReader(literalAttrsInput), space.tags, space.attrs)
+	toks, err := d.DecodeAll()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	w := bytes.NewBuffer(nil)
+	e := NewEncoder(w, space.tags, space.attrs)
+	err = e.EncodeHeader(d.Header)
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	for _, tok := range toks {
+		err := e.EncodeToken(tok)
+		if err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+	}
+	assert.Equal(t, literalAttrsInput, w.Bytes())
+
+	// not in the string table
+	e = NewEncoder(bytes.NewBuffer(nil), space.tags, space.attrs)
+	err = e.EncodeToken(StartElement{Name: "CARD", Attr: []Attr{{"lang", "fr"}}})
+	assert.NotNil(t, err)
+}
+
+func TestValidateEncodable(t *testing.T) {
+	space := tagSpaceExamples[1]
+	type input struct {
+		NAME  string `wbxml:",attr"`
+		COLOR string `wbxml:",attr"`
+		EXTRA string `wbxml:",omitunknown"`
+	}
+	type card struct {
+		INPUT []input
+		DO    *wmlAttrsDo
+		LABEL string
+		Attrs []Attr `wbxml:",attrs"`
+	}
+	var deck struct {
+		CARD card
+	}
+	errs := ValidateEncodable(&deck, space.tags, space.attrs)
+	expected := []error{
+		errors.New("input.COLOR: unknown attribute COLOR"),
+		errors.New("card.LABEL: unknown tag LABEL"),
+	}
+	assert.Equal(t, expected, errs)
+
+	assert.Equal(t, []error(nil), ValidateEncodable(deck.CARD.DO, space.tags, space.attrs))
+}
+
+func TestEncoderLiteralTags(t *testing.T) {
+	d := NewDecoder(bytes.NewReader(literalTagsInput), CodeSpace{}, CodeSpace{})
+	toks, err := d.DecodeAll()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	w := bytes.NewBuffer(nil)
+	e := NewEncoder(w, CodeSpace{}, CodeSpace{})
+	e.LiteralTags = true
+	err = e.EncodeHeader(d.Header)
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	for _, tok := range toks {
+		err := e.EncodeToken(tok)
+		if err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+	}
+	assert.Equal(t, literalTagsInput, w.Bytes())
+
+	// unknown tags are errors by default
+	e = NewEncoder(bytes.NewBuffer(nil), CodeSpace{}, CodeSpace{})
+	err = e.EncodeHeader(d.Header)
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	err = e.EncodeToken(toks[0])
+	assert.Equal(t, errors.New("unknown tag SyncML"), err)
+
+	// a deferred header gets the names of the literals
+	w.Reset()
+	e = NewEncoder(w, CodeSpace{}, CodeSpace{})
+	e.LiteralTags = true
+	e.DeferHeader(Header{Version: 3, PublicID: 1, Charset: 106})
+	err = e.EncodeElement("x", StartElement{Name: "Data"})
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	err = e.Close()
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	expected := []byte{0x03, 0x01, 0x6A, 0x05, 'D', 'a', 't', 'a', 0x00, 0x44, 0x00, 0x03, 'x', 0x00, 0x01}
+	assert.Equal(t, expected, w.Bytes())
+}
+
+type joinedLangsMsg struct {
+	Data []string `wbxml:"Data,join= ,split= "`
+}
+
+func TestEncoderEncodeJoin(t *testing.T) {
+	msg := joinedLangsMsg{Data: []string{"en", "fr", "de"}}
+	w := bytes.NewBuffer(nil)
+	e := NewEncoder(w, syncMLTags, CodeSpace{})
+	err := e.EncodeHeader(Header{Version: 3, PublicID: 1, Charset: 106})
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	err = e.EncodeElement(msg, StartElement{Name: "SyncML"})
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	expected := []byte{0x03, 0x01, 0x6A, 0x00, 0x6D, 0x4F, 0x03, 'e', 'n', ' ', 'f', 'r', ' ', 'd', 'e', 0x00, 0x01, 0x01}
+	assert.Equal(t, expected, w.Bytes())
+
+	var result joinedLangsMsg
+	err = NewDecoder(w, syncMLTags, CodeSpace{}).Decode(&result)
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	assert.Equal(t, msg, result)
+}
+
+func TestEncoderExtensions(t *testing.T) {
+	// Data with EXT_I_1 "var", a text, EXT_T_2 4 and EXT_0
+	input := []byte{0x03, 0x01, 0x6A, 0x00, 0x4F, 0x41, 'v', 'a', 'r', 0x00, 0x03, 'a', 0x00,
+		0x82, 0x04, 0xC0, 0x01}
+	d := NewDecoder(bytes.NewReader(input), syncMLTags, CodeSpace{})
+	toks, err := d.DecodeAll()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	assert.Equal(t, 6, len(toks))
+
+	w := bytes.NewBuffer(nil)
+	e := NewEncoder(w, syncMLTags, CodeSpace{})
+	err = e.EncodeHeader(d.Header)
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	for _, tok := range toks {
+		err := e.EncodeToken(tok)
+		if err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+	}
+	assert.Equal(t, input, w.Bytes())
+
+	err = e.EncodeToken(Extension{ID: 3, Kind: ExtByte})
+	assert.NotNil(t, err)
+}
+
+type emptyFields struct {
+	Data   []byte
+	Meta   map[string]string
+	LocURI string
+	Source *endpoint
+}
+
+type omitEmptyFields struct {
+	Data   []byte            `wbxml:",omitempty"`
+	Meta   map[string]string `wbxml:",omitempty"`
+	LocURI string            `wbxml:",omitempty"`
+	Source *endpoint         `wbxml:",omitempty"`
+}
+
+func TestEncoderEmptyValues(t *testing.T) {
+	tests := []struct {
+		v        interface{}
+		expected []byte
+	}{
+		// nil pointers are never written, other empty values are written without content
+		{emptyFields{}, []byte{0x54, 0x0F, 0x1A, 0x17, 0x01}},
+		{emptyFields{Data: []byte{}, Meta: map[string]string{}}, []byte{0x54, 0x0F, 0x1A, 0x17, 0x01}},
+		{omitEmptyFields{}, []byte{0x14}},
+		{omitEmptyFields{Data: []byte{}, Meta: map[string]string{}}, []byte{0x14}},
+		{
+			omitEmptyFields{
+				Data:   []byte{0x01},
+				Meta:   map[string]string{"Cmd": "b", "Item": "", "Data": "a"},
+				LocURI: "c",
+				Source: &endpoint{},
+			},
+			[]byte{0x54,
+				0x4F, 0xC3, 0x01, 0x01, 0x01,
+				0x5A, 0x4A, 0x03, 'b', 0x00, 0x01, 0x4F, 0x03, 'a', 0x00, 0x01, 0x14, 0x01,
+				0x57, 0x03, 'c', 0x00, 0x01,
+				0x67, 0x17, 0x01,
+				0x01},
+		},
+	}
+	for testID, test := range tests {
+		w := bytes.NewBuffer(nil)
+		err := NewEncoder(w, syncMLTags, CodeSpace{}).EncodeElement(test.v, StartElement{Name: "Item"})
+		if err != nil {
+			t.Errorf("case %d: unexpected error: %s", testID, err)
+		}
+		assert.Equal(t, test.expected, w.Bytes(), "case %d", testID)
+	}
+
+	err := NewEncoder(bytes.NewBuffer(nil), syncMLTags, CodeSpace{}).EncodeElement(map[int]string{1: "a"}, StartElement{Name: "Meta"})
+	assert.NotNil(t, err)
+}
+
+type taggedStatus struct {
+	ID        uint32 `wbxml:"CmdID"`
+	Reference int    `wbxml:"CmdRef"`
+	Command   string `wbxml:"Cmd,omitempty"`
+}
+
+func TestEncoderTagNames(t *testing.T) {
+	st := taggedStatus{ID: 1, Reference: 2, Command: "Put"}
+	w := bytes.NewBuffer(nil)
+	e := NewEncoder(w, syncMLTags, CodeSpace{})
+	err := e.EncodeHeader(Header{Version: 3, PublicID: 1, Charset: 106})
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	err = e.EncodeElement(st, StartElement{Name: "Status"})
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+
+	toks, err := NewDecoder(bytes.NewReader(w.Bytes()), syncMLTags, CodeSpace{}).DecodeAll()
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	var names []string
+	for _, tok := range toks {
+		if start, ok := tok.(StartElement); ok {
+			names = append(names, start.Name)
+		}
+	}
+	assert.Equal(t, []string{"Status", "CmdID", "CmdRef", "Cmd"}, names)
+
+	var result taggedStatus
+	err = NewDecoder(w, syncMLTags, CodeSpace{}).Decode(&result)
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	assert.Equal(t, st, result)
+	assert.Equal(t, []error(nil), ValidateEncodable(st, syncMLTags, CodeSpace{}))
+}
+
+type omitEmptyStatus struct {
+	CmdID  uint32 `wbxml:",omitempty"`
+	CmdRef int    `wbxml:",omitempty"`
+	Cmd    string `wbxml:",omitempty"`
+	Data   []byte `wbxml:",omitempty"`
+	Final  bool   `wbxml:",omitempty"`
+}
+
+func TestEncoderOmitEmpty(t *testing.T) {
+	tests := []struct {
+		v        interface{}
+		expected []byte
+	}{
+		{omitEmptyStatus{}, []byte{0x29}},
+		{omitEmptyStatus{CmdID: 1}, []byte{0x69, 0x4B, 0x02, 0x01, 0x01, 0x01}},
+		{omitEmptyStatus{CmdRef: 2}, []byte{0x69, 0x4C, 0x02, 0x02, 0x01, 0x01}},
+		{omitEmptyStatus{Cmd: "Put"}, []byte{0x69, 0x4A, 0x03, 'P', 'u', 't', 0x00, 0x01, 0x01}},
+		{omitEmptyStatus{Data: []byte{0x01}}, []byte{0x69, 0x4F, 0xC3, 0x01, 0x01, 0x01, 0x01}},
+		{omitEmptyStatus{Final: true}, []byte{0x69, 0x52, 0x01, 0x01}},
+		// without omitempty, the zero numbers are written
+		{status{}, []byte{0x69, 0x4B, 0x02, 0x00, 0x01, 0x5C, 0x02, 0x00, 0x01, 0x4C, 0x02, 0x00, 0x01, 0x0A, 0x4F, 0x02, 0x00, 0x01, 0x01}},
+	}
+	for testID, test := range tests {
+		w := bytes.NewBuffer(nil)
+		err := NewEncoder(w, syncMLTags, CodeSpace{}).EncodeElement(test.v, StartElement{Name: "Status"})
+		if err != nil {
+			t.Errorf("case %d: unexpected error: %s", testID, err)
+		}
+		assert.Equal(t, test.expected, w.Bytes(), "case %d", testID)
+	}
+}
+
+type finalStatus struct {
+	Final bool
+}
+
+type skippedStatus struct {
+	Final bool
+	Cmd   *string
+	Data  []byte `wbxml:",omitempty"`
+}
+
+func TestEncoderSkippedFieldsContent(t *testing.T) {
+	cmd := "Put"
+	tests := []struct {
+		v        interface{}
+		expected []byte
+	}{
+		{finalStatus{}, []byte{0x29}},
+		{finalStatus{Final: true}, []byte{0x69, 0x52, 0x01, 0x01}},
+		{skippedStatus{}, []byte{0x29}},
+		{skippedStatus{Cmd: &cmd}, []byte{0x69, 0x4A, 0x03, 'P', 'u', 't', 0x00, 0x01, 0x01}},
+	}
+	for testID, test := range tests {
+		w := bytes.NewBuffer(nil)
+		err := NewEncoder(w, syncMLTags, CodeSpace{}).EncodeElement(test.v, StartElement{Name: "Status"})
+		if err != nil {
+			t.Errorf("case %d: unexpected error: %s", testID, err)
+		}
+		assert.Equal(t, test.expected, w.Bytes(), "case %d", testID)
+	}
+}
+
+func TestEncoderNamedAttrs(t *testing.T) {
+	space := tagSpaceExamples[1]
+	w := bytes.NewBuffer(nil)
+	err := NewEncoder(w, space.tags, space.attrs).EncodeElement(wmlInput{Name: "abc", Key: 12}, StartElement{Name: "INPUT"})
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	assert.Equal(t, wmlInputInput, w.Bytes())
+}
+
+type acceptDo string
+
+func (url acceptDo) MarshalWBXMLTokens(start StartElement) ([]Token, error) {
+	start.Attr = []Attr{{"TYPE", "ACCEPT"}, {"URL", string(url)}}
+	return []Token{start, EndElement{Name: start.Name}}, nil
+}
+
+func TestEncoderEncodeTokenMarshaler(t *testing.T) {
+	space := tagSpaceExamples[1]
+	var card struct {
+		DO acceptDo
+	}
+	card.DO = "xyz"
+
+	w := bytes.NewBuffer(nil)
+	e := NewEncoder(w, space.tags, space.attrs)
+	err := e.EncodeElement(card, StartElement{Name: "CARD"})
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	expected := []byte{0x45,
+		0x88, 0x06, 0x86, 0x08, 0x03, 'x', 'y', 'z', 0x00, 0x01,
+		0x01}
+	assert.Equal(t, expected, w.Bytes())
+}
@@ -0,0 +1,73 @@
+package wbxml
+
+import (
+	"reflect"
+	"strings"
+)
+
+// tagOptions is the string following a comma in a struct field's "wbxml"
+// tag, or the empty string.
+type tagOptions string
+
+// parseTag splits a struct field's wbxml tag into its name and
+// comma-separated options.
+func parseTag(tag string) (string, tagOptions) {
+	if idx := strings.Index(tag, ","); idx != -1 {
+		return tag[:idx], tagOptions(tag[idx+1:])
+	}
+	return tag, tagOptions("")
+}
+
+// Contains reports whether a comma-separated list of options contains a
+// particular optionName flag.
+func (o tagOptions) Contains(optionName string) bool {
+	if len(o) == 0 {
+		return false
+	}
+	s := string(o)
+	for s != "" {
+		var next string
+		i := strings.Index(s, ",")
+		if i >= 0 {
+			s, next = s[:i], s[i+1:]
+		}
+		if s == optionName {
+			return true
+		}
+		s = next
+	}
+	return false
+}
+
+// Value returns the value of a "optionName=value" option of a comma-separated list of
+// options, and whether the option is present.
+func (o tagOptions) Value(optionName string) (string, bool) {
+	s := string(o)
+	for s != "" {
+		var next string
+		i := strings.Index(s, ",")
+		if i >= 0 {
+			s, next = s[:i], s[i+1:]
+		}
+		if strings.HasPrefix(s, optionName+"=") {
+			return s[len(optionName)+1:], true
+		}
+		s = next
+	}
+	return "", false
+}
+
+// fieldName returns the name of the element of the struct field sf: the name of its
+// wbxml tag, else the name of the field.
+func fieldName(sf reflect.StructField) string {
+	if name, _ := parseTag(sf.Tag.Get("wbxml")); name != "" {
+		return name
+	}
+	return sf.Name
+}
+
+// isElement reports whether a field tagged with o is mapped to a child element.
+func (o tagOptions) isElement() bool {
+	return !o.Contains("attr") && !o.Contains("attrs") && !o.Contains("chardata") &&
+		!o.Contains("seen") && !o.Contains("name")
+}
@@ -4,19 +4,20 @@ Package wbxml implements a simple WBXML parser, based on encoding/xml API.
 Specifications of the standard are available at https://www.w3.org/TR/wbxml.
 
 This package supports decoding most WBXML construct, except:
-  - Process Instruction (PI)
-  - Literal tag and attribute (LITERAL)
-  - Extension are not supported (EXT*)
+  - Single-byte extensions (EXT_*) in attribute values
 
 When decoding, some restrictions apply:
-  - Attribute values decode to string or []byte only
+  - Attribute values decode to string, integer and RegisterEnum fields (,attr), or to a []Attr of all of them (,attrs)
   - Entity, string and  are aggregated to one CharData if they are consecutive
+  - Strings are converted to UTF-8 from the charset of the header, when it is known
+  - Maps must have string keys, and get an entry for each child element
 
 When encoding a struct, some restrictions apply:
-  - Fields cannot be mapped to attributes
-  - slice other than []byte are not supported
+  - Only string and integer fields can be mapped to attributes (,attr), or a []Attr to all of them (,attrs)
+  - slice other than []byte, [][]byte and []string tagged ,join=sep are not supported
+  - Maps must have string keys, and write a child element for each entry
 
-Golang attributes are not supported for now.
+Struct fields map to the elements named by their wbxml tag, else by the name of the field.
 
 WBXML grammar is:
   start		= version publicid charset strtbl body
@@ -55,8 +56,10 @@ WBXML grammar is:
 package wbxml
 
 import (
+	"encoding/json"
 	"fmt"
 	"io"
+	"sort"
 	"unicode/utf8"
 )
 
@@ -77,19 +80,70 @@ func (space CodeSpace) Name(pageID byte, code byte) (string, error) {
 	return name, nil
 }
 
+// CodeSpaceEntry is the name of a tag or attribute in a CodeSpace, with its page and code.
+type CodeSpaceEntry struct {
+	Page byte
+	Code byte
+	Name string
+}
+
+// Entries returns all the entries of space, sorted by page then by code.
+func (space CodeSpace) Entries() []CodeSpaceEntry {
+	var entries []CodeSpaceEntry
+	for pageID, page := range space {
+		for code, name := range page {
+			entries = append(entries, CodeSpaceEntry{Page: pageID, Code: code, Name: name})
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Page != entries[j].Page {
+			return entries[i].Page < entries[j].Page
+		}
+		return entries[i].Code < entries[j].Code
+	})
+	return entries
+}
+
+// Dump writes space to w as a JSON object, mapping each page number to an object of the
+// codes of the page to their name. The result can be read back by LoadCodeSpace.
+func (space CodeSpace) Dump(w io.Writer) error {
+	data, err := json.MarshalIndent(space, "", "\t")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(data, '\n'))
+	return err
+}
+
+// LoadCodeSpace reads a CodeSpace in the format written by CodeSpace.Dump.
+func LoadCodeSpace(r io.Reader) (CodeSpace, error) {
+	var space CodeSpace
+	err := json.NewDecoder(r).Decode(&space)
+	if err != nil {
+		return nil, fmt.Errorf("invalid code space: %s", err)
+	}
+	return space, nil
+}
+
 // CodePage represents a mapping between code and tag/attribute.
 type CodePage map[byte]string
 
 // Token is an interface holding one of the token types:
-// StartElement, EndElement, CharData, Entity, Opaque, ProcInst.
+// StartElement, EndElement, CharData, Entity, Opaque, OpaqueReader, ProcInst, Extension,
+// SwitchPage.
 type Token interface{}
 
 // StartElement represent the start tag of an WBXML element.
+// StartOffset is the position of the tag in the document, and EndOffset the position of
+// the byte following the tag and its attributes, so that both delimit the start tag.
+// Offset is the position of the last byte of the start tag.
 type StartElement struct {
-	Name    string
-	Attr    []Attr
-	Content bool
-	Offset  int
+	Name        string
+	Attr        []Attr
+	Content     bool
+	Offset      int
+	StartOffset int
+	EndOffset   int
 }
 
 // Attr represents an attribute of WBXML element.
@@ -99,9 +153,14 @@ type Attr struct {
 }
 
 // EndElement represents the end tag of an WBXML element.
+// StartOffset is the position of its END token, and Offset and EndOffset the position
+// of the byte following it. All are the EndOffset of the StartElement for an element
+// without content, which has no END token.
 type EndElement struct {
-	Name   string
-	Offset int
+	Name        string
+	Offset      int
+	StartOffset int
+	EndOffset   int
 }
 
 // ProcInst represents a processor instruction (PI) in a WBXML document.
@@ -116,18 +175,74 @@ type CharData []byte
 // Opaque represents an Opaque string of data.
 type Opaque []byte
 
+// OpaqueReader represents an Opaque string of data read directly from the WBXML stream,
+// returned instead of Opaque by a Decoder with StreamOpaque set. N is the number of bytes
+// left to read. The reader is only valid until the next call to Decoder.Token, which
+// skips the bytes left unread.
+type OpaqueReader struct {
+	*io.LimitedReader
+}
+
+// SwitchPage represents a SWITCH_PAGE to a tag code page, returned by a Decoder with
+// EmitSwitchPage set. An Encoder writes it as-is, so that a document can be re-encoded
+// with its page switches at the same places.
+type SwitchPage byte
+
 // Entity represents a WBXML entity, used only when alone, else it is concatenated to the previous
 // CharData.
 type Entity uint32
 
-// UTF8 converts an entity to a valid utf sequence.
+// UTF8 converts an entity to a valid utf sequence. An entity that is not a valid code
+// point converts to U+FFFD.
 func (ent Entity) UTF8() []byte {
-	var buf [4]byte
-	rlen := utf8.RuneLen(rune(ent))
-	utf8.EncodeRune(buf[:rlen], rune(ent))
-	return buf[:rlen]
+	var buf [utf8.UTFMax]byte
+	n := utf8.EncodeRune(buf[:], rune(ent))
+	return buf[:n]
+}
+
+// EntitiesToString converts a sequence of entities to a string. An entity that is not a
+// valid code point converts to U+FFFD.
+func EntitiesToString(entities []Entity) string {
+	var buf []byte
+	for _, ent := range entities {
+		buf = append(buf, ent.UTF8()...)
+	}
+	return string(buf)
+}
+
+// StringToEntities converts a string to the entities of its code points, for example to
+// encode a character that the charset of the document cannot represent.
+func StringToEntities(s string) []Entity {
+	entities := make([]Entity, 0, utf8.RuneCountInString(s))
+	for _, r := range s {
+		entities = append(entities, Entity(r))
+	}
+	return entities
 }
 
+// ExtensionKind identifies the form of a document-type-specific extension token.
+type ExtensionKind byte
+
+const (
+	// ExtString is an inline string extension (EXT_I_0, EXT_I_1, EXT_I_2).
+	ExtString ExtensionKind = iota
+	// ExtInteger is an inline integer extension (EXT_T_0, EXT_T_1, EXT_T_2).
+	ExtInteger
+	// ExtByte is a single-byte extension (EXT_0, EXT_1, EXT_2).
+	ExtByte
+)
+
+// Extension represents a document-type-specific extension token.
+type Extension struct {
+	ID    byte          // extension number: 0, 1 or 2
+	Kind  ExtensionKind // form of the extension
+	Data  []byte        // string following an ExtString
+	Index uint32        // integer following an ExtInteger
+}
+
+// maxVersion is the version byte of WBXML 1.3, the latest version of the standard.
+const maxVersion = 0x03
+
 // Header represents the header of a wbxml document.
 type Header struct {
 	Version     uint8
@@ -136,6 +251,23 @@ type Header struct {
 	StringTable []byte
 }
 
+// VersionMajor returns the major version number of the document, stored minus one in
+// the high nibble of the version byte.
+func (h Header) VersionMajor() int {
+	return int(h.Version>>4) + 1
+}
+
+// VersionMinor returns the minor version number of the document, stored in the low
+// nibble of the version byte.
+func (h Header) VersionMinor() int {
+	return int(h.Version & 0x0F)
+}
+
+// VersionString returns the version of the document as "major.minor", 0x03 being "1.3".
+func (h Header) VersionString() string {
+	return fmt.Sprintf("%d.%d", h.VersionMajor(), h.VersionMinor())
+}
+
 const (
 	gloSwitchPage = 0x0  // 	Change the code page for the current token state. Followed by a single u_int8 indicating the new code page number.
 	gloEnd        = 0x1  // 	Indicates the end of an attribute list or the end of an element.
@@ -159,12 +291,35 @@ const (
 	gloLiteralAC  = 0xC4 // 	Unknown tag, with content and attributes.
 )
 
+// SyntaxError represents a malformed WBXML document, found at byte Offset.
+type SyntaxError struct {
+	Msg    string
+	Offset int
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("position %d: %s", e.Offset, e.Msg)
+}
+
+// Warning represents a non fatal issue of a WBXML document, found at byte Offset.
+type Warning struct {
+	Msg    string
+	Offset int
+}
+
+func (w Warning) String() string {
+	return fmt.Sprintf("position %d: %s", w.Offset, w.Msg)
+}
+
 func (d *Decoder) panicErr(err error) {
 	if err != nil {
 		if err == io.EOF {
 			panic(err)
 		}
-		panic(fmt.Errorf("position %d: %s", d.offset, err))
+		if _, ok := err.(*SyntaxError); ok {
+			panic(err)
+		}
+		panic(&SyntaxError{Msg: err.Error(), Offset: d.offset})
 	}
 }
 
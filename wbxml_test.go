@@ -0,0 +1,84 @@
+package wbxml
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHeaderVersion(t *testing.T) {
+	tests := []struct {
+		version byte
+		major   int
+		minor   int
+		str     string
+	}{
+		{0x00, 1, 0, "1.0"},
+		{0x01, 1, 1, "1.1"},
+		{0x02, 1, 2, "1.2"},
+		{0x03, 1, 3, "1.3"},
+		{0x12, 2, 2, "2.2"},
+	}
+
+	for testID, test := range tests {
+		h := Header{Version: test.version}
+		assert.Equal(t, test.major, h.VersionMajor(), "case %d", testID)
+		assert.Equal(t, test.minor, h.VersionMinor(), "case %d", testID)
+		assert.Equal(t, test.str, h.VersionString(), "case %d", testID)
+	}
+}
+
+func TestCodeSpaceEntries(t *testing.T) {
+	entries := syncMLTags.Entries()
+
+	count := 0
+	for _, page := range syncMLTags {
+		count += len(page)
+	}
+	assert.Equal(t, count, len(entries))
+	assert.Equal(t, CodeSpaceEntry{Page: 0, Code: 0x05, Name: "Add"}, entries[0])
+	assert.Equal(t, CodeSpaceEntry{Page: 8, Code: 0x0B, Name: "Stop"}, entries[len(entries)-1])
+
+	for i := 1; i < len(entries); i++ {
+		prev, cur := entries[i-1], entries[i]
+		if prev.Page > cur.Page || (prev.Page == cur.Page && prev.Code >= cur.Code) {
+			t.Errorf("entry %d %+v is not sorted after %+v", i, cur, prev)
+		}
+		assert.Equal(t, syncMLTags[cur.Page][cur.Code], cur.Name)
+	}
+}
+
+func TestCodeSpaceDump(t *testing.T) {
+	w := bytes.NewBuffer(nil)
+	err := syncMLTags.Dump(w)
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	space, err := LoadCodeSpace(w)
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	assert.Equal(t, syncMLTags, space)
+
+	w.Reset()
+	err = CodeSpace{0: CodePage{0x05: "BR"}}.Dump(w)
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	assert.Equal(t, "{\n\t\"0\": {\n\t\t\"5\": \"BR\"\n\t}\n}\n", w.String())
+
+	_, err = LoadCodeSpace(strings.NewReader(`{"0": {"256": "BR"}}`))
+	assert.NotNil(t, err)
+}
+
+func TestEntitiesString(t *testing.T) {
+	str := "a\u00A0\u00E9\U0001D11E\U0001F600"
+	entities := StringToEntities(str)
+	assert.Equal(t, []Entity{0x61, 0xA0, 0xE9, 0x1D11E, 0x1F600}, entities)
+	assert.Equal(t, str, EntitiesToString(entities))
+
+	assert.Equal(t, []Entity{}, StringToEntities(""))
+	assert.Equal(t, "\uFFFD", EntitiesToString([]Entity{0xD800}))
+}
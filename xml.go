@@ -5,13 +5,31 @@ import (
 	"encoding/xml"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"strconv"
+	"strings"
 )
 
 // XML pretty print WBXML to textual XML
 func XML(w io.Writer, wb *Decoder, indent string) (finalError error) {
+	return XMLWithOptions(w, wb, XMLOptions{Indent: indent})
+}
+
+// XMLOptions controls the textual XML written by XMLWithOptions.
+type XMLOptions struct {
+	// Indent is the string repeated for each level of nesting.
+	Indent string
+
+	// CollapseWhitespace trims the text nodes, and collapses their runs of white space
+	// to a single space, as a browser renders them. Text nodes made of white space only
+	// are dropped.
+	CollapseWhitespace bool
+}
+
+// XMLWithOptions pretty print WBXML to textual XML, as configured by opts.
+func XMLWithOptions(w io.Writer, wb *Decoder, opts XMLOptions) (finalError error) {
 	x := xml.NewEncoder(w)
-	x.Indent("", indent)
+	x.Indent("", opts.Indent)
 	defer func() {
 		err := x.Flush()
 		if err != nil {
@@ -32,13 +50,31 @@ func XML(w io.Writer, wb *Decoder, indent string) (finalError error) {
 				Attr: mapAttrToXML(t.Attr),
 			})
 		case CharData:
+			if opts.CollapseWhitespace {
+				t = CharData(strings.Join(strings.Fields(string(t)), " "))
+				if len(t) == 0 {
+					continue
+				}
+			}
 			x.EncodeToken(xml.CharData(t))
 		case Opaque:
 			x.EncodeToken(xml.CharData(hex.EncodeToString(t)))
+		case OpaqueReader:
+			data, err := ioutil.ReadAll(t)
+			if err != nil {
+				return err
+			}
+			x.EncodeToken(xml.CharData(hex.EncodeToString(data)))
 		case Entity:
 			x.EncodeToken(xml.CharData(strconv.FormatInt(int64(t), 10)))
 		case EndElement:
 			x.EncodeToken(xml.EndElement{Name: xml.Name{Local: t.Name}})
+		case ProcInst:
+			x.EncodeToken(xml.ProcInst{Target: t.Target, Inst: t.Inst})
+		case Extension:
+			x.EncodeToken(xml.Comment(extensionComment(t)))
+		case SwitchPage:
+			// code pages have no meaning in textual XML
 		default:
 			return fmt.Errorf("unknown token %T:\n  %+v", t, t)
 		}
@@ -55,3 +91,15 @@ func mapAttrToXML(attrs []Attr) []xml.Attr {
 	}
 	return x
 }
+
+// extensionComment renders an extension as the text of an XML comment.
+func extensionComment(ext Extension) string {
+	switch ext.Kind {
+	case ExtString:
+		return fmt.Sprintf(" EXT_I_%d %s ", ext.ID, strconv.Quote(string(ext.Data)))
+	case ExtInteger:
+		return fmt.Sprintf(" EXT_T_%d %d ", ext.ID, ext.Index)
+	default:
+		return fmt.Sprintf(" EXT_%d ", ext.ID)
+	}
+}
@@ -6,6 +6,9 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
 )
 
 var syncMLTags = CodeSpace{
@@ -145,3 +148,50 @@ func ExampleXML() {
 	//   </SyncBody>
 	// </SyncML>
 }
+
+func TestXMLProcInstAndExtension(t *testing.T) {
+	d := NewTokenDecoder([]Token{
+		ProcInst{Target: "target", Inst: []byte("inst")},
+		StartElement{Name: "SyncML", Content: true},
+		Extension{ID: 0, Kind: ExtString, Data: []byte("var")},
+		CharData("text"),
+		Extension{ID: 1, Kind: ExtInteger, Index: 12},
+		Extension{ID: 2, Kind: ExtByte},
+		EndElement{Name: "SyncML"},
+	})
+	w := bytes.NewBuffer(nil)
+
+	err := XML(w, d, "")
+	if err != nil && err != io.EOF {
+		t.Errorf("unexpected error: %s", err)
+	}
+	expected := `<?target inst?><SyncML><!-- EXT_I_0 "var" -->text<!-- EXT_T_1 12 --><!-- EXT_2 --></SyncML>`
+	assert.Equal(t, expected, w.String())
+}
+
+func TestXMLCollapseWhitespace(t *testing.T) {
+	toks := []Token{
+		StartElement{Name: "SyncML", Content: true},
+		StartElement{Name: "Data", Content: true},
+		CharData("  Enter \t name:\n "),
+		EndElement{Name: "Data"},
+		StartElement{Name: "Data", Content: true},
+		CharData("   "),
+		EndElement{Name: "Data"},
+		EndElement{Name: "SyncML"},
+	}
+
+	w := bytes.NewBuffer(nil)
+	err := XML(w, NewTokenDecoder(toks), "")
+	if err != nil && err != io.EOF {
+		t.Errorf("unexpected error: %s", err)
+	}
+	assert.Equal(t, "<SyncML><Data>  Enter &#x9; name:\n </Data><Data>   </Data></SyncML>", w.String())
+
+	w.Reset()
+	err = XMLWithOptions(w, NewTokenDecoder(toks), XMLOptions{CollapseWhitespace: true})
+	if err != nil && err != io.EOF {
+		t.Errorf("unexpected error: %s", err)
+	}
+	assert.Equal(t, "<SyncML><Data>Enter name:</Data><Data></Data></SyncML>", w.String())
+}